@@ -28,8 +28,13 @@ func PostService(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if len(in.Url) == 0 {
-        in.Url = "/"
+    if err := in.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if len(in.DefaultPool) == 0 {
+        in.DefaultPool = "prod"
     }
 
     if err := proxy.PostService(in); err != nil {
@@ -48,6 +53,7 @@ func GetService(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    w.Header().Set("ETag", etag(service.Version))
     json.NewEncoder(w).Encode(service)
 }
 
@@ -61,28 +67,39 @@ func PutService(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if len(in.Url) == 0 {
-        in.Url = "/"
+    if err := in.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
     }
 
     in.Name = sname
 
-    err := proxy.PutService(in)
+    versions, err := ifMatch(r)
     if err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
+
+    if err := proxy.PutService(in, versions...); err != nil {
+        adminError(w, err)
+        return
+    }
 }
 
 func DeleteService(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     sname := vars["service"]
 
-    err := proxy.DeleteService(sname)
+    versions, err := ifMatch(r)
     if err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
+
+    if err := proxy.DeleteService(sname, versions...); err != nil {
+        adminError(w, err)
+        return
+    }
 }
 
 func ListServicePool(w http.ResponseWriter, r *http.Request) {
@@ -98,6 +115,45 @@ func ListServicePool(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(pools)
 }
 
+func PostServicePool(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    in := new(Pool)
+    if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if len(in.Name) == 0 {
+        http.Error(w, "empty pool name", http.StatusBadRequest)
+        return
+    }
+
+    if len(in.LBPolicy) == 0 {
+        in.LBPolicy = "random"
+    }
+
+    if in.Pattern != nil {
+        if err := in.Pattern.Validate(); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    if in.Headers != nil {
+        if err := in.Headers.Validate(); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    if err := proxy.PostServicePool(sname, in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
 func GetServicePool(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     sname := vars["service"]
@@ -109,6 +165,7 @@ func GetServicePool(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    w.Header().Set("ETag", etag(pool.Version))
     json.NewEncoder(w).Encode(pool)
 }
 
@@ -127,10 +184,30 @@ func PutServicePool(w http.ResponseWriter, r *http.Request) {
         in.LBPolicy = "random"
     }
 
-    if err := proxy.PutServicePool(sname, pname, in); err != nil {
+    if in.Pattern != nil {
+        if err := in.Pattern.Validate(); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    if in.Headers != nil {
+        if err := in.Headers.Validate(); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    versions, err := ifMatch(r)
+    if err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
+
+    if err := proxy.PutServicePool(sname, pname, in, versions...); err != nil {
+        adminError(w, err)
+        return
+    }
 }
 
 func DeleteServicePool(w http.ResponseWriter, r *http.Request) {
@@ -138,10 +215,16 @@ func DeleteServicePool(w http.ResponseWriter, r *http.Request) {
     sname := vars["service"]
     pname := vars["pool"]
 
-    if err := proxy.DeleteServicePool(sname, pname); err != nil {
+    versions, err := ifMatch(r)
+    if err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
+
+    if err := proxy.DeleteServicePool(sname, pname, versions...); err != nil {
+        adminError(w, err)
+        return
+    }
 }
 
 func ListServicePoolNode(w http.ResponseWriter, r *http.Request) {
@@ -198,6 +281,7 @@ func GetServicePoolNode(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    w.Header().Set("ETag", etag(node.Version))
     json.NewEncoder(w).Encode(node)
 }
 
@@ -215,10 +299,16 @@ func PutServicePoolNode(w http.ResponseWriter, r *http.Request) {
 
     in.Name = nname
 
-    if err := proxy.PutServicePoolNode(sname, pname, in); err != nil {
+    versions, err := ifMatch(r)
+    if err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
+
+    if err := proxy.PutServicePoolNode(sname, pname, in, versions...); err != nil {
+        adminError(w, err)
+        return
+    }
 }
 
 func DeleteServicePoolNode(w http.ResponseWriter, r *http.Request) {
@@ -227,8 +317,491 @@ func DeleteServicePoolNode(w http.ResponseWriter, r *http.Request) {
     pname := vars["pool"]
     nname := vars["node"]
 
-    if err := proxy.DeleteServicePoolNode(sname, pname, nname); err != nil {
+    versions, err := ifMatch(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := proxy.DeleteServicePoolNode(sname, pname, nname, versions...); err != nil {
+        adminError(w, err)
+        return
+    }
+}
+
+func ListServiceRateLimit(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    limits, err := proxy.ListServiceRateLimit(sname)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(limits)
+}
+
+func PostServiceRateLimit(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    in := new(RateLimit)
+    if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if len(in.Name) == 0 {
+        http.Error(w, "empty rate limit name", http.StatusBadRequest)
+        return
+    }
+
+    if err := in.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := proxy.PostServiceRateLimit(sname, in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func GetServiceRateLimit(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+    rname := vars["ratelimit"]
+
+    limit, err := proxy.GetServiceRateLimit(sname, rname)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(limit)
+}
+
+func PutServiceRateLimit(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+    rname := vars["ratelimit"]
+
+    in := new(RateLimit)
+    if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    in.Name = rname
+
+    if err := in.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := proxy.PutServiceRateLimit(sname, in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func DeleteServiceRateLimit(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+    rname := vars["ratelimit"]
+
+    if err := proxy.DeleteServiceRateLimit(sname, rname); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func Metrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    proxy.Metrics().WriteTo(w)
+}
+
+func GetServiceSplit(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    split, err := proxy.GetServiceSplit(sname)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(split)
+}
+
+func PutServiceSplit(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    in := new(Split)
+    if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := in.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := proxy.PutServiceSplit(sname, in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func DeleteServiceSplit(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    if err := proxy.PutServiceSplit(sname, nil); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func ListServiceRollout(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    rollouts, err := proxy.ListServiceRollout(sname)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(rollouts)
+}
+
+func PostServiceRollout(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    in := new(Rollout)
+    if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := in.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := proxy.PostServiceRollout(sname, in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func GetServiceRollout(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    rollout, err := proxy.GetServiceRollout(sname)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(rollout)
+}
+
+func DeleteServiceRollout(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    if err := proxy.DeleteServiceRollout(sname); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func GetServicePromotion(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    promotion, err := proxy.GetServicePromotion(sname)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(promotion)
+}
+
+func PromoteService(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    in := struct {
+        Pool   string `json:"pool"`
+        Unload bool   `json:"unload"`
+    }{Pool: "gray"}
+
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+            http.Error(w, "invalid request body", http.StatusBadRequest)
+            return
+        }
+    }
+
+    if err := proxy.PromoteService(sname, in.Pool, in.Unload); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func RollbackService(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    if err := proxy.RollbackService(sname); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func GetServiceHeaders(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    headers, err := proxy.GetServiceHeaders(sname)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(headers)
+}
+
+func PutServiceHeaders(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    in := new(Headers)
+    if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := in.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := proxy.PutServiceHeaders(sname, in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func DeleteServiceHeaders(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    if err := proxy.PutServiceHeaders(sname, nil); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func GetServiceMirror(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    mirror, err := proxy.GetServiceMirror(sname)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(mirror)
+}
+
+func PutServiceMirror(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    in := new(Mirror)
+    if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := in.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := proxy.PutServiceMirror(sname, in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func DeleteServiceMirror(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    if err := proxy.PutServiceMirror(sname, nil); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func GetServiceBreaker(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    status, err := proxy.GetServiceBreaker(sname)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(status)
+}
+
+func PutServiceBreaker(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    in := new(Breaker)
+    if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := in.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := proxy.PutServiceBreaker(sname, in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func DeleteServiceBreaker(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    if err := proxy.PutServiceBreaker(sname, nil); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func TripServiceBreaker(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    if err := proxy.TripServiceBreaker(sname); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func ResetServiceBreaker(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+
+    if err := proxy.ResetServiceBreaker(sname); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func GetServicePoolNodeBreaker(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+    pname := vars["pool"]
+    nname := vars["node"]
+
+    status, err := proxy.GetServicePoolNodeBreaker(sname, pname, nname)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    json.NewEncoder(w).Encode(status)
+}
+
+func TripServicePoolNodeBreaker(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+    pname := vars["pool"]
+    nname := vars["node"]
+
+    if err := proxy.TripServicePoolNodeBreaker(sname, pname, nname); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func ResetServicePoolNodeBreaker(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    sname := vars["service"]
+    pname := vars["pool"]
+    nname := vars["node"]
+
+    if err := proxy.ResetServicePoolNodeBreaker(sname, pname, nname); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+}
+
+func RouteTest(w http.ResponseWriter, r *http.Request) {
+    in := new(RouteTestRequest)
+    if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    req, err := in.request()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    explain, err := proxy.RouteTest(req)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    json.NewEncoder(w).Encode(explain)
+}
+
+func Batch(w http.ResponseWriter, r *http.Request) {
+    in := make([]*BatchOp, 0)
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
+
+    for i, op := range in {
+        if op == nil {
+            http.Error(w, fmt.Sprintf("operation %d: null", i), http.StatusBadRequest)
+            return
+        }
+
+        if err := op.Validate(); err != nil {
+            http.Error(w, fmt.Sprintf("operation %d %s: %v", i, op.Op, err), http.StatusBadRequest)
+            return
+        }
+    }
+
+    if err := proxy.Batch(in); err != nil {
+        adminError(w, err)
+        return
+    }
 }
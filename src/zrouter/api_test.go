@@ -0,0 +1,77 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Run with -race. The handlers encode what they get from the proxy after
+// its lock is released, while requests go through and admin calls change the
+// nodes. The encoding is done here rather than through the router, whose
+// access log would order the handlers and hide the races.
+func TestAdminAPIConcurrentWithProxy(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        time.Sleep(time.Millisecond)
+    }))
+    defer ts.Close()
+
+    p := newTestProxy(t, &Node{Name: "n1", Host: backendHost(ts), Status: "on"})
+    addNode(t, p, "gray", &Node{Name: "g1", Host: backendHost(ts), Status: "on"})
+    if err := p.PostServiceRollout("s", &Rollout{Pool: "gray", Steps: []float64{50}, Interval: 1}); err != nil {
+        t.Fatal(err)
+    }
+
+    reads := []func() (interface{}, error){
+        func() (interface{}, error) { return p.ListService(), nil },
+        func() (interface{}, error) { return p.GetService("s") },
+        func() (interface{}, error) { return p.GetServicePool("s", "prod") },
+        func() (interface{}, error) { return p.ListServicePoolNode("s", "prod") },
+        func() (interface{}, error) { return p.GetServicePoolNode("s", "prod", "n1") },
+        func() (interface{}, error) { return p.GetServicePromotion("s") },
+        func() (interface{}, error) { return p.ListServiceRollout("s") },
+        func() (interface{}, error) { return p.GetServiceRollout("s") },
+    }
+
+    var wg sync.WaitGroup
+    for _, read := range reads {
+        wg.Add(1)
+        go func(read func() (interface{}, error)) {
+            defer wg.Done()
+            for i := 0; i < 100; i++ {
+                if v, err := read(); err == nil {
+                    json.NewEncoder(ioutil.Discard).Encode(v)
+                }
+            }
+        }(read)
+    }
+
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for i := 0; i < 100; i++ {
+            p.PutServicePoolNode("s", "prod", &Node{Name: "n1", Status: "on", Weight: i % 10}, 0)
+            if i%10 == 0 {
+                p.DeleteServiceRollout("s")
+                p.PromoteService("s", "gray", true)
+                p.RollbackService("s")
+            }
+        }
+    }()
+
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 50; j++ {
+                p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+            }
+        }()
+    }
+
+    wg.Wait()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "sync/atomic"
+)
+
+type BatchOp struct {
+    Op      string          `json:"op"`      // `create_service/update_service/set_pool_pattern/add_node/update_node/remove_node`
+    Service string          `json:"service"` // name of the service, that of the body if created
+    Pool    string          `json:"pool"`
+    Node    string          `json:"node"`    // name of the node updated or removed
+    Body    json.RawMessage `json:"body"`    // service, pattern or node, as in the single calls, null pattern clears it
+    Version uint64          `json:"version"` // version the service, pool or node changed must be at, any if 0, as If-Match
+    service *Service
+    pattern *Pattern
+    node    *Node
+}
+
+// Validate decodes and checks the body of the operation, so that the batch
+// fails before any change for a bad one.
+func (op *BatchOp) Validate() error {
+    switch op.Op {
+    case "create_service", "update_service":
+        op.service = new(Service)
+        if err := json.Unmarshal(op.Body, op.service); err != nil {
+            return err
+        }
+
+        if op.Op == "create_service" && len(op.service.DefaultPool) == 0 {
+            op.service.DefaultPool = "prod"
+        }
+
+        if op.Op == "update_service" || len(op.service.Name) == 0 {
+            op.service.Name = op.Service
+        }
+
+        if len(op.service.Name) == 0 {
+            return fmt.Errorf("empty service name")
+        }
+
+        return op.service.Validate()
+    case "set_pool_pattern":
+        if err := json.Unmarshal(op.Body, &op.pattern); err != nil {
+            return err
+        }
+
+        if op.pattern != nil {
+            return op.pattern.Validate()
+        }
+    case "add_node", "update_node":
+        op.node = new(Node)
+        if err := json.Unmarshal(op.Body, op.node); err != nil {
+            return err
+        }
+
+        if op.Op == "update_node" {
+            op.node.Name = op.Node
+        }
+
+        if len(op.node.Name) == 0 {
+            return fmt.Errorf("empty node name")
+        }
+
+        if op.Op == "add_node" && op.node.Status == "unloading" {
+            op.node.Status = "off"
+        }
+        op.node.ConnNum = 0
+    case "remove_node":
+    default:
+        return fmt.Errorf("invalid operation %q", op.Op)
+    }
+
+    return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// batchBackup keeps the services, pools and nodes as they were before a
+// batch, so that a failed batch puts them back in place.
+type batchBackup struct {
+    services  []*Service
+    values    map[*Service]Service
+    pools     map[*Pool]Pool
+    nodes     map[*Node]Node
+    unloading map[*Node]int32
+    commit    []func() // side effects run once the batch is published, e.g. closing the connections to removed nodes
+}
+
+func (p *Proxy) backup() *batchBackup {
+    b := &batchBackup{
+        services:  append([]*Service(nil), p.Services...),
+        values:    make(map[*Service]Service),
+        pools:     make(map[*Pool]Pool),
+        nodes:     make(map[*Node]Node),
+        unloading: make(map[*Node]int32),
+    }
+
+    for _, s := range p.Services {
+        v := *s
+        v.Pools = append([]*Pool(nil), s.Pools...)
+        b.values[s] = v
+
+        for _, pool := range s.Pools {
+            pv := *pool
+            pv.Nodes = append([]*Node(nil), pool.Nodes...)
+            b.pools[pool] = pv
+
+            for _, node := range pool.Nodes {
+                b.nodes[node] = *node
+                b.unloading[node] = atomic.LoadInt32(&node.state.unloading)
+            }
+        }
+    }
+
+    return b
+}
+
+func (p *Proxy) restore(b *batchBackup) {
+    // transports of the pools of the services created by the batch
+    for _, s := range p.Services {
+        if _, ok := b.values[s]; !ok {
+            for _, pool := range s.Pools {
+                pool.transport.retire()
+            }
+        }
+    }
+
+    p.Services = b.services
+    for s, v := range b.values {
+        *s = v
+    }
+
+    for pool, v := range b.pools {
+        *pool = v
+    }
+
+    for node, v := range b.nodes {
+        *node = v
+        atomic.StoreInt32(&node.state.unloading, b.unloading[node])
+    }
+}
+
+func (p *Proxy) setServicePoolPattern(sname, pname string, pattern *Pattern, versions ...uint64) error {
+    pool, err := p.getServicePool(sname, pname)
+    if err != nil {
+        return err
+    }
+
+    if err := checkVersion("pool "+pname, pool.Version, versions); err != nil {
+        return err
+    }
+
+    pool.Pattern = pattern
+    pool.Version = nextVersion()
+    return nil
+}
+
+func (p *Proxy) apply(op *BatchOp, b *batchBackup) error {
+    switch op.Op {
+    case "create_service":
+        return p.postService(op.service)
+    case "update_service":
+        return p.putService(op.service, op.Version)
+    case "set_pool_pattern":
+        return p.setServicePoolPattern(op.Service, op.Pool, op.pattern, op.Version)
+    case "add_node":
+        return p.postServicePoolNode(op.Service, op.Pool, op.node)
+    case "update_node":
+        return p.putServicePoolNode(op.Service, op.Pool, op.node, op.Version)
+    case "remove_node":
+        pool, node, err := p.deleteServicePoolNode(op.Service, op.Pool, op.Node, op.Version)
+        if err != nil {
+            return err
+        }
+
+        b.commit = append(b.commit, func() { pool.transport.forget(node.Host) })
+        return nil
+    }
+
+    return fmt.Errorf("invalid operation %q", op.Op)
+}
+
+// Batch applies the validated operations in order under one lock, either all
+// of them take effect or, on the first error, none. Nothing outside the
+// services changes before all of them succeed.
+func (p *Proxy) Batch(ops []*BatchOp) error {
+    p.Lock()
+    defer p.Unlock()
+
+    b := p.backup()
+    for i, op := range ops {
+        if err := p.apply(op, b); err != nil {
+            p.restore(b)
+            return fmt.Errorf("operation %d %s: %w", i, op.Op, err)
+        }
+    }
+
+    p.publish()
+    for _, f := range b.commit {
+        f()
+    }
+
+    return nil
+}
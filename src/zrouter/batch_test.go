@@ -0,0 +1,117 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+)
+
+func batchOps(t *testing.T, s string) []*BatchOp {
+    ops := make([]*BatchOp, 0)
+    if err := json.Unmarshal([]byte(s), &ops); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, op := range ops {
+        validated(t, op)
+    }
+
+    return ops
+}
+
+func TestBatchApplies(t *testing.T) {
+    p := newTestProxy(t, &Node{Name: "n1", Host: "127.0.0.1:1", Status: "on"}, &Node{Name: "n0", Host: "127.0.0.1:9", Status: "on"})
+    n0 := p.Services[0].pool("prod").transport.host("127.0.0.1:9")
+
+    err := p.Batch(batchOps(t, `[
+        {"op": "create_service", "body": {"name": "t", "url": "/t/"}},
+        {"op": "add_node", "service": "t", "pool": "prod", "body": {"name": "t1", "host": "127.0.0.1:2", "status": "on"}},
+        {"op": "set_pool_pattern", "service": "s", "pool": "gray", "body": {"type": "header", "name": "X-Gray"}},
+        {"op": "add_node", "service": "s", "pool": "prod", "body": {"name": "n2", "host": "127.0.0.1:3", "status": "on"}},
+        {"op": "update_node", "service": "s", "pool": "prod", "node": "n1", "body": {"status": "off"}},
+        {"op": "remove_node", "service": "s", "pool": "prod", "node": "n0"}
+    ]`))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if atomic.LoadInt32(&n0.gone) == 0 {
+        t.Error("connections to the removed n0 not forgotten")
+    }
+
+    if node, err := p.GetServicePoolNode("t", "prod", "t1"); err != nil || node.Status != "on" {
+        t.Errorf("node t1 = %+v, %v", node, err)
+    }
+
+    if pool, _ := p.GetServicePool("s", "gray"); pool.Pattern == nil || pool.Pattern.Name != "X-Gray" {
+        t.Errorf("pattern of gray = %+v", pool.Pattern)
+    }
+
+    if node, _ := p.GetServicePoolNode("s", "prod", "n1"); node.Status != "off" {
+        t.Errorf("status of n1 = %s, want off", node.Status)
+    }
+}
+
+func TestBatchRollsBack(t *testing.T) {
+    p := newTestProxy(t, &Node{Name: "n1", Host: "127.0.0.1:1", Status: "on"}, &Node{Name: "n2", Host: "127.0.0.1:2", Status: "on"})
+    n2 := p.Services[0].pool("prod").transport.host("127.0.0.1:2")
+
+    ops := batchOps(t, `[
+        {"op": "create_service", "body": {"name": "t"}},
+        {"op": "update_service", "service": "s", "body": {"url": "/s/"}},
+        {"op": "update_node", "service": "s", "pool": "prod", "node": "n1", "body": {"status": "unloading"}},
+        {"op": "remove_node", "service": "s", "pool": "prod", "node": "n2"},
+        {"op": "add_node", "service": "s", "pool": "prod", "body": {"name": "n3", "host": "127.0.0.1:3", "status": "on"}},
+        {"op": "add_node", "service": "s", "pool": "prod", "body": {"name": "n1", "host": "127.0.0.1:4", "status": "on"}}
+    ]`)
+    if err := p.Batch(ops); err == nil {
+        t.Fatal("batch adding a duplicate node succeeded")
+    }
+
+    for _, pool := range ops[0].service.Pools {
+        if atomic.LoadInt32(&pool.transport.retired) == 0 {
+            t.Errorf("transport of pool %s of the service rolled back not retired", pool.Name)
+        }
+    }
+
+    if atomic.LoadInt32(&n2.gone) == 1 {
+        t.Error("connections to n2 forgotten by the failed batch")
+    }
+
+    if _, err := p.GetService("t"); err == nil {
+        t.Error("service t created by the failed batch")
+    }
+
+    if s, _ := p.GetService("s"); s.Url != "/" {
+        t.Errorf("url of s = %s, want /", s.Url)
+    }
+
+    nodes, _ := p.ListServicePoolNode("s", "prod")
+    if len(nodes) != 2 || nodes[0].Name != "n1" || nodes[0].Status != "on" || nodes[1].Name != "n2" {
+        t.Errorf("nodes of prod after the failed batch = %+v", nodes)
+    }
+
+    if s := p.lookup(httptest.NewRequest("GET", "/x", nil)); s == nil || s.Name != "s" {
+        t.Errorf("published services changed by the failed batch")
+    }
+}
+
+func TestBatchValidate(t *testing.T) {
+    for _, s := range []string{
+        `{"op": "drop_service"}`,
+        `{"op": "create_service", "body": {}}`,
+        `{"op": "create_service", "body": {"name": "t", "hosts": ["~("]}}`,
+        `{"op": "set_pool_pattern", "service": "s", "pool": "gray", "body": {"type": "nope"}}`,
+        `{"op": "add_node", "service": "s", "pool": "prod", "body": {"host": "127.0.0.1:1"}}`,
+    } {
+        op := new(BatchOp)
+        if err := json.Unmarshal([]byte(s), op); err != nil {
+            t.Fatal(err)
+        }
+
+        if err := op.Validate(); err == nil {
+            t.Errorf("Validate(%s) succeeded, want error", s)
+        }
+    }
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type Breaker struct {
+    ErrorRate   float64 `json:"error_rate"`   // failure ratio opening the breaker, 0 means 0.5
+    MinRequests int     `json:"min_requests"` // requests in the window before the error rate counts, 0 means 20
+    Latency     int     `json:"latency"`      // milliseconds, a slower response counts as failure, 0 means no limit
+    Window      int     `json:"window"`       // seconds the error rate is measured over, 0 means 10
+    OpenTimeout int     `json:"open_timeout"` // seconds the breaker stays open before probing, 0 means 30
+    Probes      int     `json:"probes"`       // successful probes in half-open closing the breaker, 0 means 3
+}
+
+type BreakerStatus struct {
+    State    string    `json:"state"`    // `closed/open/half-open`
+    Since    time.Time `json:"since"`
+    Manual   bool      `json:"manual"`   // tripped by hand, stays open until reset
+    Requests int       `json:"requests"` // requests of the current window
+    Failures int       `json:"failures"`
+    Config   *Breaker  `json:"config"`   // breaker disabled if nil, only manual trips work
+}
+
+func (b *Breaker) Validate() error {
+    if b.ErrorRate < 0 || b.ErrorRate > 1 {
+        return fmt.Errorf("invalid error rate %v", b.ErrorRate)
+    }
+
+    if b.ErrorRate == 0 {
+        b.ErrorRate = 0.5
+    }
+
+    if b.MinRequests <= 0 {
+        b.MinRequests = 20
+    }
+
+    if b.Window <= 0 {
+        b.Window = 10
+    }
+
+    if b.OpenTimeout <= 0 {
+        b.OpenTimeout = 30
+    }
+
+    if b.Probes <= 0 {
+        b.Probes = 3
+    }
+
+    return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// circuit is the breaker state machine of a service or a node, it is fed with
+// the outcome of every request proxied by ServeHTTP.
+type circuit struct {
+    mu       sync.Mutex
+    config   *Breaker
+    state    string
+    since    time.Time
+    manual   bool
+    start    time.Time // start of the current window
+    requests int
+    failures int
+    probing  int // probes in flight
+    probed   int // successful probes
+    tripped  int32 // 1 unless closed, lets requests through a closed breaker without the lock
+    enabled  int32 // 1 if config is set, lets record skip a disabled breaker without the lock
+}
+
+func newCircuit(config *Breaker) *circuit {
+    now := time.Now()
+    c := &circuit{state: "closed", since: now, start: now}
+    c.setConfig(config)
+    return c
+}
+
+func (c *circuit) setConfig(config *Breaker) {
+    c.config = config
+    if config != nil {
+        atomic.StoreInt32(&c.enabled, 1)
+    } else {
+        atomic.StoreInt32(&c.enabled, 0)
+    }
+}
+
+func (c *circuit) configure(config *Breaker) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.setConfig(config)
+    if config == nil && !c.manual {
+        c.close(time.Now())
+    }
+}
+
+func (c *circuit) close(now time.Time) {
+    atomic.StoreInt32(&c.tripped, 0)
+    c.state = "closed"
+    c.since = now
+    c.manual = false
+    c.start = now
+    c.requests = 0
+    c.failures = 0
+}
+
+func (c *circuit) open(now time.Time, manual bool) {
+    atomic.StoreInt32(&c.tripped, 1)
+    c.state = "open"
+    c.since = now
+    c.manual = manual
+}
+
+// halfOpen moves an open breaker to half-open once its timeout expires.
+func (c *circuit) halfOpen(now time.Time) {
+    if c.state == "open" && !c.manual && c.config != nil &&
+        now.Sub(c.since) >= time.Duration(c.config.OpenTimeout)*time.Second {
+        c.state = "half-open"
+        c.since = now
+        c.probing = 0
+        c.probed = 0
+    }
+}
+
+// available tells whether allow would let a request pass, without taking a probe.
+func (c *circuit) available(now time.Time) bool {
+    if atomic.LoadInt32(&c.tripped) == 0 {
+        return true
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.halfOpen(now)
+
+    switch c.state {
+    case "closed":
+        return true
+    case "half-open":
+        return c.probing < c.config.Probes
+    }
+
+    return false
+}
+
+// allow tells whether a request may pass, probe is true if the request is one
+// of the probes of a half-open breaker and its outcome decides the state.
+func (c *circuit) allow(now time.Time) (ok, probe bool) {
+    if atomic.LoadInt32(&c.tripped) == 0 {
+        return true, false
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.halfOpen(now)
+
+    switch c.state {
+    case "closed":
+        return true, false
+    case "half-open":
+        if c.probing < c.config.Probes {
+            c.probing++
+            return true, true
+        }
+    }
+
+    return false, false
+}
+
+// cancel gives back the probe of a request which did not reach the upstream.
+func (c *circuit) cancel(probe bool) {
+    if !probe {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.state == "half-open" {
+        c.probing--
+    }
+}
+
+func (c *circuit) record(probe, failed bool, latency time.Duration, now time.Time) {
+    if atomic.LoadInt32(&c.enabled) == 0 {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.config == nil {
+        return
+    }
+
+    if c.config.Latency > 0 && latency > time.Duration(c.config.Latency)*time.Millisecond {
+        failed = true
+    }
+
+    switch c.state {
+    case "closed":
+        if now.Sub(c.start) >= time.Duration(c.config.Window)*time.Second {
+            c.start = now
+            c.requests = 0
+            c.failures = 0
+        }
+
+        c.requests++
+        if failed {
+            c.failures++
+        }
+
+        if c.requests >= c.config.MinRequests && float64(c.failures) >= c.config.ErrorRate*float64(c.requests) {
+            c.open(now, false)
+        }
+    case "half-open":
+        if !probe {
+            return
+        }
+
+        c.probing--
+        if failed {
+            c.open(now, false)
+            return
+        }
+
+        if c.probed++; c.probed >= c.config.Probes {
+            c.close(now)
+        }
+    }
+}
+
+func (c *circuit) trip() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.open(time.Now(), true)
+}
+
+func (c *circuit) reset() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.close(time.Now())
+}
+
+func (c *circuit) Status() *BreakerStatus {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.halfOpen(time.Now())
+
+    return &BreakerStatus{
+        State:    c.state,
+        Since:    c.since,
+        Manual:   c.manual,
+        Requests: c.requests,
+        Failures: c.failures,
+        Config:   c.config,
+    }
+}
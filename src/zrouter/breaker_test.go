@@ -0,0 +1,208 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestCircuitTransitions(t *testing.T) {
+    c := newCircuit(validated(t, &Breaker{MinRequests: 4, OpenTimeout: 1, Probes: 2}))
+    now := time.Now()
+
+    for _, failed := range []bool{false, true, false} {
+        c.record(false, failed, 0, now)
+    }
+    if c.Status().State != "closed" {
+        t.Fatal("breaker opened below min_requests")
+    }
+
+    c.record(false, true, 0, now)
+    if st := c.Status(); st.State != "open" || st.Manual {
+        t.Fatalf("state after 2 of 4 failures = %+v, want open", st)
+    }
+
+    if ok, _ := c.allow(now.Add(500 * time.Millisecond)); ok {
+        t.Error("open breaker let a request through")
+    }
+
+    // half-open after the open timeout lets the probes through, no more
+    now = now.Add(time.Second)
+    for i := 0; i < 2; i++ {
+        if ok, probe := c.allow(now); !ok || !probe {
+            t.Fatalf("probe %d: allow = %v, %v", i, ok, probe)
+        }
+    }
+
+    if ok, _ := c.allow(now); ok || c.available(now) {
+        t.Error("half-open breaker let more requests than probes through")
+    }
+
+    // results of requests let through before the breaker opened do not count
+    c.record(false, false, 0, now)
+    c.record(true, false, 0, now)
+    if c.Status().State != "half-open" {
+        t.Fatal("breaker closed before all probes succeeded")
+    }
+
+    c.record(true, false, 0, now)
+    if c.Status().State != "closed" {
+        t.Errorf("state after the probes succeeded = %s, want closed", c.Status().State)
+    }
+}
+
+func TestCircuitProbeFails(t *testing.T) {
+    c := newCircuit(validated(t, &Breaker{MinRequests: 1, OpenTimeout: 1, Probes: 2}))
+    now := time.Now()
+
+    c.record(false, true, 0, now)
+    now = now.Add(time.Second)
+    if _, probe := c.allow(now); !probe {
+        t.Fatal("no probe after the open timeout")
+    }
+
+    c.record(true, true, 0, now)
+    if st := c.Status(); st.State != "open" || !st.Since.Equal(now) {
+        t.Errorf("state after a failed probe = %+v, want open again", st)
+    }
+}
+
+func TestCircuitProbeCancel(t *testing.T) {
+    c := newCircuit(validated(t, &Breaker{MinRequests: 1, OpenTimeout: 1, Probes: 1}))
+    now := time.Now()
+
+    c.record(false, true, 0, now)
+    now = now.Add(time.Second)
+    _, probe := c.allow(now)
+    c.cancel(probe)
+    if ok, _ := c.allow(now); !ok {
+        t.Error("probe not given back by cancel")
+    }
+}
+
+func TestCircuitLatency(t *testing.T) {
+    c := newCircuit(validated(t, &Breaker{MinRequests: 2, Latency: 100}))
+    now := time.Now()
+
+    c.record(false, false, 50*time.Millisecond, now)
+    c.record(false, false, 150*time.Millisecond, now)
+    if c.Status().State != "open" {
+        t.Error("slow responses not counted as failures")
+    }
+}
+
+func TestCircuitWindow(t *testing.T) {
+    c := newCircuit(validated(t, &Breaker{MinRequests: 2, Window: 1}))
+    now := time.Now()
+
+    c.record(false, true, 0, now)
+    c.record(false, true, 0, now.Add(time.Second))
+    if st := c.Status(); st.State != "closed" || st.Requests != 1 {
+        t.Errorf("status = %+v, want the failures of the last window dropped", st)
+    }
+}
+
+func TestCircuitDisabled(t *testing.T) {
+    c := newCircuit(nil)
+    now := time.Now()
+
+    for i := 0; i < 100; i++ {
+        c.record(false, true, 0, now)
+    }
+
+    if ok, _ := c.allow(now); !ok {
+        t.Error("breaker without config opened")
+    }
+
+    c.trip()
+    if ok, _ := c.allow(now); ok {
+        t.Error("manual trip without config let a request through")
+    }
+}
+
+func TestPoolTakeReservesProbes(t *testing.T) {
+    p := newTestProxy(t, &Node{Name: "n1", Host: "127.0.0.1:1", Status: "on"})
+    b := &Breaker{MinRequests: 1, OpenTimeout: 1, Probes: 1}
+    b.Validate()
+    p.PutServiceBreaker("s", b)
+
+    pool := p.Services[0].defaultPool()
+    node := pool.Nodes[0]
+    node.circuit.record(false, true, 0, time.Now().Add(-time.Second))
+
+    l := pool.take()
+    if l.node != node || !l.probe {
+        t.Fatalf("take of a half-open node = %+v, want a probe", l)
+    }
+
+    // the only probe is taken, concurrent requests find no node
+    if l := pool.take(); l.node != nil {
+        t.Errorf("take beyond the probes = %+v, want no node", l)
+    }
+
+    p.decreaseConn(pool, node)
+    node.circuit.record(l.probe, false, 0, time.Now())
+    if l := pool.take(); l.node != node || l.probe {
+        t.Errorf("take after the probe succeeded = %+v, want a closed breaker", l)
+    }
+}
+
+func TestBreakerTripAndResetAPI(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer ts.Close()
+
+    router := NewRouter()
+    do := func(method, path, body string) *httptest.ResponseRecorder {
+        rw := httptest.NewRecorder()
+        router.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+        if rw.Code != http.StatusOK {
+            t.Fatalf("%s %s: %d %s", method, path, rw.Code, rw.Body)
+        }
+        return rw
+    }
+
+    do("POST", "/api/services", `{"name": "breaker-api", "url": "/breaker-api/"}`)
+    defer proxy.DeleteService("breaker-api", 0)
+
+    do("POST", "/api/services/breaker-api/pools/prod/nodes", `{"name": "n1", "host": "`+backendHost(ts)+`", "status": "on"}`)
+
+    serve := func() int {
+        rw := httptest.NewRecorder()
+        proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/breaker-api/", nil))
+        return rw.Code
+    }
+
+    status := func(path string) *BreakerStatus {
+        st := new(BreakerStatus)
+        json.NewDecoder(do("GET", path, "").Body).Decode(st)
+        return st
+    }
+
+    for _, c := range []struct {
+        trip, reset, get string
+    }{
+        {"/api/services/breaker-api/breaker/trip", "/api/services/breaker-api/breaker/reset", "/api/services/breaker-api/breaker"},
+        {"/api/services/breaker-api/pools/prod/nodes/n1/breaker/trip", "/api/services/breaker-api/pools/prod/nodes/n1/breaker/reset", "/api/services/breaker-api/pools/prod/nodes/n1/breaker"},
+    } {
+        do("POST", c.trip, "")
+        if st := status(c.get); st.State != "open" || !st.Manual {
+            t.Errorf("%s after trip = %+v", c.get, st)
+        }
+
+        if code := serve(); code == http.StatusOK {
+            t.Errorf("request through %s tripped: %d", c.get, code)
+        }
+
+        do("POST", c.reset, "")
+        if st := status(c.get); st.State != "closed" {
+            t.Errorf("%s after reset = %+v", c.get, st)
+        }
+
+        if code := serve(); code != http.StatusOK {
+            t.Errorf("request after reset of %s: %d", c.get, code)
+        }
+    }
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+)
+
+// trustedProxies are the networks of the load balancers in front of zrouter,
+// the X-Forwarded-For hops they append are taken as the client address.
+var trustedProxies []*net.IPNet
+
+// parseNets parses a list of IPs and CIDR ranges, a plain IP is a network
+// of itself only.
+func parseNets(list []string) ([]*net.IPNet, error) {
+    nets := make([]*net.IPNet, 0, len(list))
+    for _, s := range list {
+        s = strings.TrimSpace(s)
+        if strings.Contains(s, "/") {
+            _, n, err := net.ParseCIDR(s)
+            if err != nil {
+                return nil, fmt.Errorf("invalid cidr %q", s)
+            }
+            nets = append(nets, n)
+            continue
+        }
+
+        ip := net.ParseIP(s)
+        if ip == nil {
+            return nil, fmt.Errorf("invalid ip %q", s)
+        }
+
+        if ip4 := ip.To4(); ip4 != nil {
+            ip = ip4
+        }
+        nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+    }
+
+    return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+    for _, n := range nets {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// clientIP returns the address of the client, walking the X-Forwarded-For
+// chain from the right as long as the hops are trusted proxies.
+func clientIP(req *http.Request) net.IP {
+    host, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        host = req.RemoteAddr
+    }
+
+    ip := net.ParseIP(host)
+    if ip == nil || !containsIP(trustedProxies, ip) {
+        return ip
+    }
+
+    hops := make([]string, 0)
+    for _, v := range req.Header["X-Forwarded-For"] {
+        hops = append(hops, strings.Split(v, ",")...)
+    }
+
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := net.ParseIP(strings.TrimSpace(hops[i]))
+        if hop == nil {
+            break
+        }
+
+        ip = hop
+        if !containsIP(trustedProxies, ip) {
+            break
+        }
+    }
+
+    return ip
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "regexp"
+)
+
+var headerVar = regexp.MustCompile(`\$\{(\w+)\}`)
+
+type HeaderRule struct {
+    Action string `json:"action"` // `add/set/remove/rename`
+    Name   string `json:"name"`
+    Value  string `json:"value"`  // value of add/set, may refer to ${client_ip}, ${request_id}, ${host}, ${path}, ${query}, ${uri}, ${service}, ${pool} and ${node}
+    To     string `json:"to"`     // new name of rename
+}
+
+type Headers struct {
+    Request  []*HeaderRule `json:"request"`  // applied before the upstream call
+    Response []*HeaderRule `json:"response"` // applied before the response goes to the client
+}
+
+func (h *Headers) Validate() error {
+    for _, rules := range [][]*HeaderRule{h.Request, h.Response} {
+        for _, r := range rules {
+            if r == nil || len(r.Name) == 0 {
+                return fmt.Errorf("empty header name of rule")
+            }
+
+            switch r.Action {
+            case "add", "set", "remove":
+            case "rename":
+                if len(r.To) == 0 {
+                    return fmt.Errorf("empty new name of header %s", r.Name)
+                }
+            default:
+                return fmt.Errorf("invalid header action %q", r.Action)
+            }
+        }
+    }
+
+    return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// headerVars are the variables header values refer to, the request id is
+// taken from X-Request-Id or generated once on first use.
+type headerVars struct {
+    req       *http.Request
+    service   string
+    pool      string
+    node      string
+    requestID string
+}
+
+func (v *headerVars) get(name string) (string, bool) {
+    switch name {
+    case "client_ip":
+        if ip := clientIP(v.req); ip != nil {
+            return ip.String(), true
+        }
+        return "", true
+    case "request_id":
+        if len(v.requestID) == 0 {
+            v.requestID = v.req.Header.Get("X-Request-Id")
+        }
+        if len(v.requestID) == 0 {
+            b := make([]byte, 16)
+            rand.Read(b)
+            v.requestID = hex.EncodeToString(b)
+        }
+        return v.requestID, true
+    case "host":
+        return v.req.Host, true
+    case "path":
+        return v.req.URL.Path, true
+    case "query":
+        return v.req.URL.RawQuery, true
+    case "uri":
+        return v.req.URL.RequestURI(), true
+    case "service":
+        return v.service, true
+    case "pool":
+        return v.pool, true
+    case "node":
+        return v.node, true
+    }
+
+    return "", false
+}
+
+func (v *headerVars) expand(s string) string {
+    return headerVar.ReplaceAllStringFunc(s, func(m string) string {
+        if value, ok := v.get(m[2 : len(m)-1]); ok {
+            return value
+        }
+        return m
+    })
+}
+
+func rewriteHeader(h http.Header, rules []*HeaderRule, vars *headerVars) {
+    for _, r := range rules {
+        switch r.Action {
+        case "add":
+            h.Add(r.Name, vars.expand(r.Value))
+        case "set":
+            h.Set(r.Name, vars.expand(r.Value))
+        case "remove":
+            h.Del(r.Name)
+        case "rename":
+            if values, ok := h[http.CanonicalHeaderKey(r.Name)]; ok {
+                h.Del(r.Name)
+                h.Del(r.To)
+                for _, value := range values {
+                    h.Add(r.To, value)
+                }
+            }
+        }
+    }
+}
+
+// headerRules returns the request or response rules of the service followed
+// by those of the pool.
+func headerRules(s *Service, pool *Pool, response bool) []*HeaderRule {
+    rules := make([]*HeaderRule, 0)
+    for _, h := range []*Headers{s.Headers, pool.Headers} {
+        if h == nil {
+            continue
+        }
+
+        if response {
+            rules = append(rules, h.Response...)
+        } else {
+            rules = append(rules, h.Request...)
+        }
+    }
+
+    return rules
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+func TestRewriteHeader(t *testing.T) {
+    vars := &headerVars{req: httptest.NewRequest("GET", "/", nil)}
+
+    for _, c := range []struct {
+        rule *HeaderRule
+        want http.Header
+    }{
+        {&HeaderRule{Action: "add", Name: "X-A", Value: "2"}, http.Header{"X-A": {"1", "2"}, "X-B": {"b"}}},
+        {&HeaderRule{Action: "set", Name: "x-a", Value: "2"}, http.Header{"X-A": {"2"}, "X-B": {"b"}}},
+        {&HeaderRule{Action: "set", Name: "X-C", Value: "c"}, http.Header{"X-A": {"1"}, "X-B": {"b"}, "X-C": {"c"}}},
+        {&HeaderRule{Action: "remove", Name: "X-A"}, http.Header{"X-B": {"b"}}},
+        {&HeaderRule{Action: "rename", Name: "X-A", To: "X-B"}, http.Header{"X-B": {"1"}}},
+        {&HeaderRule{Action: "rename", Name: "X-A", To: "X-C"}, http.Header{"X-B": {"b"}, "X-C": {"1"}}},
+        {&HeaderRule{Action: "rename", Name: "X-Missing", To: "X-B"}, http.Header{"X-A": {"1"}, "X-B": {"b"}}},
+    } {
+        h := http.Header{"X-A": {"1"}, "X-B": {"b"}}
+        rewriteHeader(h, []*HeaderRule{c.rule}, vars)
+        if !reflect.DeepEqual(h, c.want) {
+            t.Errorf("%s %s: %v, want %v", c.rule.Action, c.rule.Name, h, c.want)
+        }
+    }
+}
+
+func TestHeaderVars(t *testing.T) {
+    req := httptest.NewRequest("GET", "http://example.com/a/b?x=1", nil)
+    req.RemoteAddr = "192.0.2.1:1000"
+    vars := &headerVars{req: req, service: "s", pool: "gray", node: "n1"}
+
+    got := vars.expand("${client_ip}|${host}|${path}|${query}|${uri}|${service}|${pool}|${node}|${nope}|$path")
+    if want := "192.0.2.1|example.com|/a/b|x=1|/a/b?x=1|s|gray|n1|${nope}|$path"; got != want {
+        t.Errorf("expand = %s, want %s", got, want)
+    }
+
+    // a request id is generated once and kept for the response
+    id := vars.expand("${request_id}")
+    if len(id) != 32 || vars.expand("${request_id}") != id {
+        t.Errorf("request id = %q, then %q", id, vars.expand("${request_id}"))
+    }
+
+    req.Header.Set("X-Request-Id", "abc")
+    if id := (&headerVars{req: req}).expand("${request_id}"); id != "abc" {
+        t.Errorf("request id = %q, want the one of X-Request-Id", id)
+    }
+}
+
+func TestHeaderRulesOrder(t *testing.T) {
+    var got http.Header
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        got = r.Header
+        w.Header().Set("Server", "backend")
+        w.Header().Set("X-Internal", "1")
+    }))
+    defer ts.Close()
+
+    p := newTestProxy(t, &Node{Name: "n1", Host: backendHost(ts), Status: "on"})
+    p.PutServiceHeaders("s", &Headers{
+        Request:  []*HeaderRule{{Action: "set", Name: "X-Who", Value: "service"}, {Action: "set", Name: "X-Service", Value: "${service}"}},
+        Response: []*HeaderRule{{Action: "remove", Name: "X-Internal"}, {Action: "set", Name: "Server", Value: "zrouter"}},
+    })
+    p.PutServicePool("s", "prod", &Pool{LBPolicy: "random", Headers: &Headers{
+        Request:  []*HeaderRule{{Action: "set", Name: "X-Who", Value: "${pool}"}, {Action: "rename", Name: "X-Service", To: "X-From"}},
+        Response: []*HeaderRule{{Action: "add", Name: "Server", Value: "${node}"}},
+    }}, 0)
+
+    rw := httptest.NewRecorder()
+    p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+
+    // the pool rules run after those of the service and see their changes
+    if got.Get("X-Who") != "prod" || got.Get("X-From") != "s" || len(got["X-Service"]) != 0 {
+        t.Errorf("upstream headers = %v", got)
+    }
+
+    if h := rw.Header(); !reflect.DeepEqual(h["Server"], []string{"zrouter", "n1"}) || len(h["X-Internal"]) != 0 {
+        t.Errorf("response headers = %v", h)
+    }
+}
+
+func TestHeadersValidate(t *testing.T) {
+    for _, h := range []*Headers{
+        {Request: []*HeaderRule{{Action: "set"}}},
+        {Request: []*HeaderRule{nil}},
+        {Response: []*HeaderRule{{Action: "drop", Name: "X-A"}}},
+        {Response: []*HeaderRule{{Action: "rename", Name: "X-A"}}},
+    } {
+        if err := h.Validate(); err == nil {
+            t.Errorf("Validate(%+v) succeeded, want error", h)
+        }
+    }
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// Hosts of a service are matched against the Host header of the request in
+// this order, the first match decides the services the path is looked up in:
+//
+//   1. exact names with the port of the request, e.g. `example.com:8080`
+//   2. exact names without a port, e.g. `example.com`
+//   3. wildcards, `*.example.com` matches any subdomain of example.com at any
+//      depth, longer suffixes first and those with the port of the request
+//      before those without
+//   4. regexes, `~^api[0-9]+\.example\.com$` matches the name without port,
+//      in the order of the services and their hosts
+//   5. the services without any host
+//
+// Names are case insensitive. A request without a port in Host is on port
+// 80, or 443 over TLS.
+
+type hostPattern struct {
+    kind string // `exact/wildcard/regex`
+    name string // host name, or the suffix of a wildcard, e.g. `.example.com`
+    port string // only requests to this port match, any port if empty
+    re   *regexp.Regexp
+}
+
+func parseHost(host string) (*hostPattern, error) {
+    if strings.HasPrefix(host, "~") {
+        re, err := regexp.Compile("(?i)" + host[1:])
+        if err != nil {
+            return nil, fmt.Errorf("invalid host regex %q: %v", host, err)
+        }
+        return &hostPattern{kind: "regex", name: host, re: re}, nil
+    }
+
+    h := &hostPattern{kind: "exact", name: strings.ToLower(host)}
+    if name, port, err := net.SplitHostPort(h.name); err == nil {
+        h.name, h.port = name, port
+    }
+    // brackets of IPv6 without a port, as requestHost does
+    h.name = strings.Trim(h.name, "[]")
+
+    if strings.HasPrefix(h.name, "*.") {
+        h.kind = "wildcard"
+        h.name = h.name[1:]
+    }
+
+    if len(strings.Trim(h.name, ".")) == 0 || strings.ContainsAny(h.name, "*/ ") {
+        return nil, fmt.Errorf("invalid host %q", host)
+    }
+
+    return h, nil
+}
+
+// key identifies the services sharing a host pattern.
+func (h *hostPattern) key() string {
+    if h.kind == "regex" {
+        return h.name
+    }
+
+    return h.name + ":" + h.port
+}
+
+// parseHosts checks the hosts of the service, Host is one more of them.
+func (s *Service) parseHosts() error {
+    hosts := s.Hosts
+    if len(s.Host) > 0 {
+        hosts = append([]string{s.Host}, hosts...)
+    }
+
+    s.hosts = make([]*hostPattern, 0, len(hosts))
+    for _, host := range hosts {
+        h, err := parseHost(host)
+        if err != nil {
+            return err
+        }
+        s.hosts = append(s.hosts, h)
+    }
+
+    return nil
+}
+
+// requestHost returns the lower case name and the port the request is for.
+func requestHost(req *http.Request) (string, string) {
+    host, port := req.Host, ""
+    if h, p, err := net.SplitHostPort(host); err == nil {
+        host, port = h, p
+    }
+
+    if len(port) == 0 {
+        port = "80"
+        if req.TLS != nil {
+            port = "443"
+        }
+    }
+
+    return strings.ToLower(strings.Trim(host, "[]")), port
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type hostRoute struct {
+    host *hostPattern
+    root *radixNode
+}
+
+// hostRoutes holds the path trees of the hosts by kind, see the order above.
+type hostRoutes struct {
+    exact     map[string]*radixNode
+    wildcards []*hostRoute
+    regexes   []*hostRoute
+    fallback  *radixNode
+}
+
+func newHostRoutes(services []*Service) *hostRoutes {
+    r := &hostRoutes{exact: make(map[string]*radixNode)}
+    patterns := make(map[string]*hostRoute)
+
+    for _, s := range services {
+        if len(s.hosts) == 0 {
+            if r.fallback == nil {
+                r.fallback = new(radixNode)
+            }
+            r.fallback.insert(s.Url, s)
+            continue
+        }
+
+        for _, h := range s.hosts {
+            if h.kind == "exact" {
+                root := r.exact[h.key()]
+                if root == nil {
+                    root = new(radixNode)
+                    r.exact[h.key()] = root
+                }
+                root.insert(s.Url, s)
+                continue
+            }
+
+            route := patterns[h.key()]
+            if route == nil {
+                route = &hostRoute{host: h, root: new(radixNode)}
+                patterns[h.key()] = route
+                if h.kind == "wildcard" {
+                    r.wildcards = append(r.wildcards, route)
+                } else {
+                    r.regexes = append(r.regexes, route)
+                }
+            }
+            route.root.insert(s.Url, s)
+        }
+    }
+
+    sort.SliceStable(r.wildcards, func(i, j int) bool {
+        a, b := r.wildcards[i].host, r.wildcards[j].host
+        if len(a.name) != len(b.name) {
+            return len(a.name) > len(b.name)
+        }
+        return len(a.port) > len(b.port)
+    })
+
+    return r
+}
+
+// match returns the path tree of the first host pattern matching the request.
+func (r *hostRoutes) match(req *http.Request) *radixNode {
+    host, port := requestHost(req)
+
+    if root := r.exact[host+":"+port]; root != nil {
+        return root
+    }
+
+    if root := r.exact[host+":"]; root != nil {
+        return root
+    }
+
+    for _, route := range r.wildcards {
+        h := route.host
+        if strings.HasSuffix(host, h.name) && len(host) > len(h.name) && (len(h.port) == 0 || h.port == port) {
+            return route.root
+        }
+    }
+
+    for _, route := range r.regexes {
+        if route.host.re.MatchString(host) {
+            return route.root
+        }
+    }
+
+    return r.fallback
+}
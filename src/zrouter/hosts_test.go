@@ -0,0 +1,88 @@
+package main
+
+import (
+    "crypto/tls"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestHostPrecedence(t *testing.T) {
+    services := []*Service{
+        {Name: "default", Url: "/"},
+        {Name: "exact", Host: "www.example.com", Url: "/"},
+        {Name: "exact-port", Hosts: []string{"www.example.com:8080"}, Url: "/"},
+        {Name: "multi", Hosts: []string{"a.example.org", "B.Example.Org"}, Url: "/"},
+        {Name: "wildcard", Hosts: []string{"*.example.com"}, Url: "/"},
+        {Name: "wildcard-deep", Hosts: []string{"*.eu.example.com"}, Url: "/"},
+        {Name: "wildcard-port", Hosts: []string{"*.example.com:8443"}, Url: "/"},
+        {Name: "regex", Hosts: []string{`~^api[0-9]+\.example\.(com|net)$`}, Url: "/"},
+        {Name: "tls", Hosts: []string{"secure.example.net:443"}, Url: "/"},
+        {Name: "ipv6", Host: "[::1]", Url: "/"},
+        {Name: "ipv6-port", Hosts: []string{"[::1]:8443"}, Url: "/"},
+    }
+    table := mustRouteTable(t, services)
+
+    tests := []struct {
+        host string
+        tls  bool
+        want string
+    }{
+        {"www.example.com", false, "exact"},
+        {"WWW.EXAMPLE.COM", false, "exact"},
+        {"www.example.com:80", false, "exact"},
+        {"www.example.com:8080", false, "exact-port"},
+        {"www.example.com:9090", false, "exact"},
+        {"a.example.org", false, "multi"},
+        {"b.example.org:81", false, "multi"},
+        {"shop.example.com", false, "wildcard"},
+        {"a.b.example.com", false, "wildcard"},
+        {"fr.eu.example.com", false, "wildcard-deep"},
+        {"shop.example.com:8443", false, "wildcard-port"},
+        {"example.com", false, "default"},
+        {"api1.example.com", false, "wildcard"}, // wildcard before regex
+        {"api1.example.net", false, "regex"},
+        {"API2.example.net:8080", false, "regex"},
+        {"secure.example.net", true, "tls"},
+        {"secure.example.net", false, "default"},
+        {"other.org", false, "default"},
+        {"[::1]", false, "ipv6"},
+        {"[::1]:8080", false, "ipv6"},
+        {"[::1]:8443", false, "ipv6-port"},
+        {"[::2]:8080", false, "default"},
+    }
+
+    for _, test := range tests {
+        req := httptest.NewRequest("GET", "/", nil)
+        req.Host = test.host
+        if test.tls {
+            req.TLS = new(tls.ConnectionState)
+        }
+
+        got := ""
+        if s := table.lookup(req); s != nil {
+            got = s.Name
+        }
+
+        if got != test.want {
+            t.Errorf("lookup(%s, tls %v) = %q, want %q", test.host, test.tls, got, test.want)
+        }
+    }
+}
+
+func TestHostNoDefault(t *testing.T) {
+    table := mustRouteTable(t, []*Service{{Name: "exact", Host: "www.example.com", Url: "/"}})
+
+    req := httptest.NewRequest("GET", "/", nil)
+    req.Host = "other.example.com"
+    if s := table.lookup(req); s != nil {
+        t.Errorf("lookup(%s) = %s, want nil", req.Host, s.Name)
+    }
+}
+
+func TestParseHostInvalid(t *testing.T) {
+    for _, host := range []string{"~(", "*", "*.", "a*.example.com", "www.example.com/path", ":8080"} {
+        if _, err := parseHost(host); err == nil {
+            t.Errorf("parseHost(%q) succeeded, want error", host)
+        }
+    }
+}
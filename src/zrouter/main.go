@@ -1,8 +1,11 @@
 package main
 
 import (
+    "flag"
     "log"
     "net/http"
+    "strings"
+    "time"
 )
 
 func startStatusServer() {
@@ -11,6 +14,23 @@ func startStatusServer() {
 }
 
 func main() {
+    redisAddr := flag.String("ratelimit-redis", "", "redis `address` sharing rate limit counters among replicas")
+    redisTimeout := flag.Duration("ratelimit-redis-timeout", 100*time.Millisecond, "timeout of rate limit counter requests")
+    trusted := flag.String("trusted-proxies", "", "comma separated IPs and CIDR ranges whose X-Forwarded-For is trusted")
+    flag.Parse()
+
+    if len(*trusted) > 0 {
+        nets, err := parseNets(strings.Split(*trusted, ","))
+        if err != nil {
+            log.Fatalln(err)
+        }
+        trustedProxies = nets
+    }
+
+    if len(*redisAddr) > 0 {
+        proxy.counters = newSharedCounters(newRedisStore(*redisAddr, *redisTimeout))
+    }
+
     go startStatusServer()
     log.Printf("Starting proxy server on port 10001 ...\n")
     log.Fatalln(http.ListenAndServe(":10001", proxy))
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+)
+
+const maintenanceBody = "<html><body><h1>Service Unavailable</h1><p>The service is under maintenance, please retry later.</p></body></html>\n"
+
+type Maintenance struct {
+    Enabled     bool     `json:"enabled"`
+    RetryAfter  int      `json:"retry_after"`  // seconds sent in Retry-After, 0 means 300
+    ContentType string   `json:"content_type"` // of the page, `text/html; charset=utf-8` by default
+    Body        string   `json:"body"`         // page returned with 503, a generic page by default
+    Allow       *Pattern `json:"allow"`        // requests still proxied for verification, e.g. an internal header or ip range
+    Pool        string   `json:"pool"`         // pool the allowed requests go to, `debug` by default
+}
+
+func (m *Maintenance) Validate() error {
+    if m.RetryAfter < 0 {
+        return fmt.Errorf("invalid retry_after %d", m.RetryAfter)
+    }
+
+    if m.RetryAfter == 0 {
+        m.RetryAfter = 300
+    }
+
+    if len(m.ContentType) == 0 {
+        m.ContentType = "text/html; charset=utf-8"
+    }
+
+    if len(m.Body) == 0 {
+        m.Body = maintenanceBody
+    }
+
+    if len(m.Pool) == 0 {
+        m.Pool = "debug"
+    }
+
+    if m.Allow != nil {
+        return m.Allow.Validate()
+    }
+
+    return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// maintain answers the request with the maintenance page if the service is
+// under maintenance and the request is not allowed through, lookupPool sends
+// the allowed ones to the maintenance pool.
+func (p *Proxy) maintain(s *Service, rw http.ResponseWriter, req *http.Request) bool {
+    m := s.Maintenance
+    if m == nil || !m.Enabled || (m.Allow != nil && m.Allow.Match(req)) {
+        return false
+    }
+
+    rw.Header().Set("Content-Type", m.ContentType)
+    rw.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+    rw.WriteHeader(http.StatusServiceUnavailable)
+    io.WriteString(rw, m.Body)
+    return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// newMaintenanceProxy returns a proxy with a node in prod and one in debug,
+// each answering with the name of its pool.
+func newMaintenanceProxy(t *testing.T) *Proxy {
+    backend := func(name string) string {
+        return startBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            io.WriteString(w, name)
+        }))
+    }
+
+    p := newTestProxy(t, &Node{Name: "n1", Host: backend("prod"), Status: "on"})
+    addNode(t, p, "debug", &Node{Name: "d1", Host: backend("debug"), Status: "on"})
+    return p
+}
+
+func putMaintenance(t *testing.T, p *Proxy, m *Maintenance) {
+    validated(t, m)
+    if err := p.PutService(&Service{Name: "s", Url: "/", Maintenance: m}, 0); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestMaintenancePage(t *testing.T) {
+    p := newMaintenanceProxy(t)
+    putMaintenance(t, p, &Maintenance{Enabled: true})
+
+    rw := httptest.NewRecorder()
+    p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+    if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") != "300" ||
+        rw.Header().Get("Content-Type") != "text/html; charset=utf-8" || rw.Body.String() != maintenanceBody {
+        t.Errorf("default page: %d %v %s", rw.Code, rw.Header(), rw.Body)
+    }
+
+    putMaintenance(t, p, &Maintenance{Enabled: true, RetryAfter: 60, ContentType: "application/json", Body: `{"maintenance":true}`})
+
+    rw = httptest.NewRecorder()
+    p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+    if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") != "60" ||
+        rw.Header().Get("Content-Type") != "application/json" || rw.Body.String() != `{"maintenance":true}` {
+        t.Errorf("custom page: %d %v %s", rw.Code, rw.Header(), rw.Body)
+    }
+
+    putMaintenance(t, p, &Maintenance{Enabled: false})
+
+    rw = httptest.NewRecorder()
+    p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+    if rw.Code != http.StatusOK || rw.Body.String() != "prod" {
+        t.Errorf("disabled maintenance: %d %s, want prod", rw.Code, rw.Body)
+    }
+}
+
+func TestMaintenanceAllow(t *testing.T) {
+    p := newMaintenanceProxy(t)
+    putMaintenance(t, p, &Maintenance{Enabled: true, Allow: validated(t, &Pattern{Type: "header", Name: "X-Verify"})})
+
+    for _, c := range []struct {
+        verify bool
+        code   int
+        body   string
+    }{
+        {false, http.StatusServiceUnavailable, maintenanceBody},
+        {true, http.StatusOK, "debug"},
+    } {
+        req := httptest.NewRequest("GET", "/", nil)
+        if c.verify {
+            req.Header.Set("X-Verify", "1")
+        }
+
+        rw := httptest.NewRecorder()
+        p.ServeHTTP(rw, req)
+        if rw.Code != c.code || rw.Body.String() != c.body {
+            t.Errorf("verify %v: %d %s, want %d %s", c.verify, rw.Code, rw.Body, c.code, c.body)
+        }
+    }
+
+    // allowed requests go to the maintenance pool, not the one they match
+    putMaintenance(t, p, &Maintenance{Enabled: true, Allow: validated(t, &Pattern{Type: "header", Name: "X-Verify"}), Pool: "prod"})
+
+    req := httptest.NewRequest("GET", "/", nil)
+    req.Header.Set("X-Verify", "1")
+    rw := httptest.NewRecorder()
+    p.ServeHTTP(rw, req)
+    if rw.Code != http.StatusOK || rw.Body.String() != "prod" {
+        t.Errorf("maintenance pool prod: %d %s", rw.Code, rw.Body)
+    }
+}
+
+func TestMaintenanceValidate(t *testing.T) {
+    if err := (&Maintenance{RetryAfter: -1}).Validate(); err == nil {
+        t.Error("negative retry_after accepted")
+    }
+
+    p := newTestProxy(t)
+    m := &Maintenance{Enabled: true, Pool: "missing"}
+    m.Validate()
+    if err := p.PutService(&Service{Name: "s", Url: "/", Maintenance: m}, 0); err == nil {
+        t.Error("maintenance of a missing pool accepted")
+    }
+
+    if err := p.DeleteServicePool("s", "debug", 0); err != nil {
+        t.Fatal(err)
+    }
+    m = &Maintenance{Enabled: true}
+    m.Validate()
+    if err := p.PutService(&Service{Name: "s", Url: "/", Maintenance: m}, 0); err == nil {
+        t.Error("maintenance of the deleted debug pool accepted")
+    }
+}
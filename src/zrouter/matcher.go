@@ -0,0 +1,76 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "regexp"
+    "sort"
+    "strings"
+
+    "github.com/gorilla/mux"
+)
+
+// Matcher narrows the requests of a service beyond host and Url prefix, so
+// that several services share a prefix. It is compiled to a gorilla/mux route.
+type Matcher struct {
+    Methods []string          `json:"methods"` // any method if empty
+    Path    string            `json:"path"`    // whole path, a mux template, e.g. `/users/{id:[0-9]+}`, or `~regex`
+    Queries map[string]string `json:"queries"` // query parameter values, mux templates, empty matches any value
+    Headers map[string]string `json:"headers"` // header value regexes, empty matches any value
+    route   *mux.Route
+}
+
+func (m *Matcher) Validate() error {
+    route := new(mux.Router).NewRoute()
+
+    if len(m.Methods) > 0 {
+        route.Methods(m.Methods...)
+    }
+
+    if strings.HasPrefix(m.Path, "~") {
+        re, err := regexp.Compile(m.Path[1:])
+        if err != nil {
+            return fmt.Errorf("invalid path regex of matcher: %v", err)
+        }
+        route.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+            return re.MatchString(req.URL.Path)
+        })
+    } else if len(m.Path) > 0 {
+        route.Path(m.Path)
+    }
+
+    for _, k := range sortedKeys(m.Queries) {
+        route.Queries(k, m.Queries[k])
+    }
+
+    for _, k := range sortedKeys(m.Headers) {
+        route.HeadersRegexp(k, m.Headers[k])
+    }
+
+    if err := route.GetError(); err != nil {
+        return fmt.Errorf("invalid matcher: %v", err)
+    }
+
+    m.route = route
+    return nil
+}
+
+func (m *Matcher) Match(req *http.Request) bool {
+    return m.route.Match(req, new(mux.RouteMatch))
+}
+
+func sortedKeys(m map[string]string) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    return keys
+}
+
+// matches tells whether the request falls into the service once its host and
+// Url match.
+func (s *Service) matches(req *http.Request) bool {
+    return s.Match == nil || s.Match.Match(req)
+}
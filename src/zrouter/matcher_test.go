@@ -0,0 +1,69 @@
+package main
+
+import (
+    "net/http/httptest"
+    "testing"
+)
+
+func TestMatcherRouting(t *testing.T) {
+    services := []*Service{
+        {Name: "root", Url: "/"},
+        {Name: "api", Url: "/api/"},
+        {Name: "api-write", Url: "/api/", Priority: 1, Match: validated(t, &Matcher{Methods: []string{"POST", "PUT"}})},
+        {Name: "api-user", Url: "/api/", Priority: 10, Match: validated(t, &Matcher{Path: "/api/users/{id:[0-9]+}"})},
+        {Name: "api-beta", Url: "/api/", Priority: 5, Match: validated(t, &Matcher{Headers: map[string]string{"X-Beta": "^(1|true)$"}})},
+        {Name: "api-v2", Url: "/api/", Priority: 5, Match: validated(t, &Matcher{Queries: map[string]string{"v": "2"}})},
+        {Name: "static", Url: "/", Priority: 1, Match: validated(t, &Matcher{Path: `~\.(css|js)$`, Methods: []string{"GET"}})},
+        {Name: "upload", Url: "/upload/", Match: validated(t, &Matcher{Methods: []string{"POST"}})},
+    }
+    table := mustRouteTable(t, services)
+
+    tests := []struct {
+        method, target string
+        headers        map[string]string
+        want           string
+    }{
+        {"GET", "/api/items", nil, "api"},
+        {"POST", "/api/items", nil, "api-write"},
+        {"GET", "/api/users/42", nil, "api-user"},
+        {"POST", "/api/users/42", nil, "api-user"},
+        {"GET", "/api/users/bob", nil, "api"},
+        {"GET", "/api/items", map[string]string{"X-Beta": "true"}, "api-beta"},
+        {"GET", "/api/items", map[string]string{"X-Beta": "no"}, "api"},
+        {"GET", "/api/items?v=2", nil, "api-v2"},
+        {"GET", "/api/items?v=3", nil, "api"},
+        {"GET", "/app.js", nil, "static"},
+        {"HEAD", "/app.js", nil, "root"},
+        {"POST", "/upload/a", nil, "upload"},
+        {"GET", "/upload/a", nil, "root"}, // no service of /upload/ matches, the shorter prefix does
+    }
+
+    for _, test := range tests {
+        req := httptest.NewRequest(test.method, test.target, nil)
+        for k, v := range test.headers {
+            req.Header.Set(k, v)
+        }
+
+        got := ""
+        if s := table.lookup(req); s != nil {
+            got = s.Name
+        }
+
+        if got != test.want {
+            t.Errorf("lookup(%s %s %v) = %q, want %q", test.method, test.target, test.headers, got, test.want)
+        }
+    }
+}
+
+func TestMatcherInvalid(t *testing.T) {
+    for _, m := range []*Matcher{
+        {Path: "/users/{id"},
+        {Path: "~("},
+        {Headers: map[string]string{"X-A": "("}},
+        {Queries: map[string]string{"a": "{b:(}"}},
+    } {
+        if err := m.Validate(); err == nil {
+            t.Errorf("Validate(%+v) succeeded, want error", m)
+        }
+    }
+}
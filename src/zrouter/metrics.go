@@ -0,0 +1,146 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// metrics collects samples in the prometheus text format.
+type metrics struct {
+    families []*metricFamily
+    index    map[string]*metricFamily
+}
+
+type metricFamily struct {
+    name    string
+    kind    string // `counter/gauge`
+    help    string
+    samples []string
+}
+
+func newMetrics() *metrics {
+    return &metrics{index: make(map[string]*metricFamily)}
+}
+
+// add appends a sample of the family, labels are given as name, value pairs.
+func (m *metrics) add(name, kind, help string, value float64, labels ...string) {
+    f, ok := m.index[name]
+    if !ok {
+        f = &metricFamily{name: name, kind: kind, help: help}
+        m.families = append(m.families, f)
+        m.index[name] = f
+    }
+
+    pairs := make([]string, 0, len(labels)/2)
+    for i := 0; i+1 < len(labels); i += 2 {
+        pairs = append(pairs, fmt.Sprintf("%s=%s", labels[i], strconv.Quote(labels[i+1])))
+    }
+
+    sample := name
+    if len(pairs) > 0 {
+        sample += "{" + strings.Join(pairs, ",") + "}"
+    }
+
+    f.samples = append(f.samples, sample+" "+strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (m *metrics) WriteTo(w io.Writer) (int64, error) {
+    var total int64
+    for _, f := range m.families {
+        n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s\n", f.name, f.help, f.name, f.kind, strings.Join(f.samples, "\n"))
+        total += int64(n)
+        if err != nil {
+            return total, err
+        }
+    }
+
+    return total, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// trafficStats counts the requests proxied to a pool, the counters only grow
+// and rates are taken from the difference of two snapshots.
+type trafficStats struct {
+    requests int64
+    failures int64
+    latency  int64 // nanoseconds in total
+}
+
+func (t *trafficStats) observe(failed bool, latency time.Duration) {
+    atomic.AddInt64(&t.requests, 1)
+    if failed {
+        atomic.AddInt64(&t.failures, 1)
+    }
+    atomic.AddInt64(&t.latency, int64(latency))
+}
+
+func (t *trafficStats) snapshot() trafficStats {
+    return trafficStats{
+        requests: atomic.LoadInt64(&t.requests),
+        failures: atomic.LoadInt64(&t.failures),
+        latency:  atomic.LoadInt64(&t.latency),
+    }
+}
+
+// since returns the error rate and the mean latency of the requests after
+// the earlier snapshot.
+func (t trafficStats) since(earlier trafficStats) (requests int64, errorRate float64, latency time.Duration) {
+    requests = t.requests - earlier.requests
+    if requests == 0 {
+        return 0, 0, 0
+    }
+
+    errorRate = float64(t.failures-earlier.failures) / float64(requests)
+    latency = time.Duration((t.latency - earlier.latency) / requests)
+    return requests, errorRate, latency
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func breakerOpen(c *circuit) float64 {
+    if c.Status().State == "closed" {
+        return 0
+    }
+
+    return 1
+}
+
+func (p *Proxy) Metrics() *metrics {
+    p.Lock()
+    defer p.Unlock()
+
+    m := newMetrics()
+    for _, s := range p.Services {
+        m.add("zrouter_service_breaker_open", "gauge", "Whether the breaker of the service is not closed.", breakerOpen(s.circuit), "service", s.Name)
+
+        if s.Mirror != nil {
+            st := s.Mirror.Stats()
+            m.add("zrouter_mirror_requests_total", "counter", "Request copies sent to the mirror.", float64(st.Requests), "service", s.Name)
+            m.add("zrouter_mirror_errors_total", "counter", "Request copies failed with an upstream error or a 5xx status.", float64(st.Errors), "service", s.Name)
+            m.add("zrouter_mirror_skipped_total", "counter", "Requests sampled for the mirror but not copied.", float64(st.Skipped), "service", s.Name)
+            m.add("zrouter_mirror_latency_seconds_total", "counter", "Time to mirror response headers in total.", st.Latency*float64(st.Requests)/1000, "service", s.Name)
+        }
+
+        for _, pool := range s.Pools {
+            pname := pool.Name
+            m.add("zrouter_pool_pending", "gauge", "Requests waiting for a busy node.", float64(atomic.LoadInt64(&pool.queue.pending)), "service", s.Name, "pool", pname)
+            m.add("zrouter_pool_rejected_total", "counter", "Requests rejected for a full queue or a queue timeout.", float64(atomic.LoadInt64(&pool.queue.rejected)), "service", s.Name, "pool", pname)
+
+            t := pool.traffic.snapshot()
+            m.add("zrouter_pool_requests_total", "counter", "Requests proxied to the pool.", float64(t.requests), "service", s.Name, "pool", pname)
+            m.add("zrouter_pool_failures_total", "counter", "Requests failed with an upstream error or a 5xx status.", float64(t.failures), "service", s.Name, "pool", pname)
+            m.add("zrouter_pool_latency_seconds_total", "counter", "Time to upstream response headers in total.", time.Duration(t.latency).Seconds(), "service", s.Name, "pool", pname)
+            for _, node := range pool.Nodes {
+                m.add("zrouter_node_conns", "gauge", "Requests in flight to the node.", float64(node.connNum()), "service", s.Name, "pool", pname, "node", node.Name)
+                m.add("zrouter_node_breaker_open", "gauge", "Whether the breaker of the node is not closed.", breakerOpen(node.circuit), "service", s.Name, "pool", pname, "node", node.Name)
+            }
+        }
+    }
+
+    return m
+}
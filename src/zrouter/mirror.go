@@ -0,0 +1,175 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "math/rand"
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+const maxMirrorsInFlight = 128
+
+type Mirror struct {
+    Pool    string  `json:"pool"`     // pool the copies go to, e.g. `debug`
+    Host    string  `json:"host"`     // external `host:port` the copies go to instead of a pool
+    Percent float64 `json:"percent"`  // percentage of the requests copied, `0 ~ 100`
+    MaxBody int64   `json:"max_body"` // bytes of request body copied at most, 0 means 65536, requests with bigger bodies are skipped
+    Timeout int     `json:"timeout"`  // milliseconds a copy may take, 0 means 5000
+    stats   *mirrorStats
+    client  *poolTransport // transport to the external host, created by PutServiceMirror
+}
+
+type MirrorStats struct {
+    Requests int64   `json:"requests"` // copies sent
+    Errors   int64   `json:"errors"`   // copies failed with an upstream error or a 5xx status
+    Skipped  int64   `json:"skipped"`  // requests sampled but not copied, for body size, no node or too many copies in flight
+    InFlight int64   `json:"in_flight"`
+    Latency  float64 `json:"latency"`  // mean milliseconds to response headers
+}
+
+type MirrorStatus struct {
+    Config *Mirror      `json:"config"`
+    Stats  *MirrorStats `json:"stats"`
+}
+
+type mirrorStats struct {
+    requests int64
+    errors   int64
+    skipped  int64
+    inFlight int64
+    latency  int64 // nanoseconds in total
+}
+
+func (m *Mirror) Validate() error {
+    if (len(m.Pool) == 0) == (len(m.Host) == 0) {
+        return fmt.Errorf("either pool or host of mirror is required")
+    }
+
+    if m.Percent < 0 || m.Percent > 100 {
+        return fmt.Errorf("invalid mirror percentage %v", m.Percent)
+    }
+
+    if m.MaxBody <= 0 {
+        m.MaxBody = 65536
+    }
+
+    if m.Timeout <= 0 {
+        m.Timeout = 5000
+    }
+
+    m.stats = new(mirrorStats)
+    return nil
+}
+
+func (m *Mirror) Stats() *MirrorStats {
+    st := &MirrorStats{
+        Requests: atomic.LoadInt64(&m.stats.requests),
+        Errors:   atomic.LoadInt64(&m.stats.errors),
+        Skipped:  atomic.LoadInt64(&m.stats.skipped),
+        InFlight: atomic.LoadInt64(&m.stats.inFlight),
+    }
+
+    if st.Requests > 0 {
+        st.Latency = milliseconds(time.Duration(atomic.LoadInt64(&m.stats.latency) / st.Requests))
+    }
+
+    return st
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// mirror copies a sampled share of the requests to the mirror target in the
+// background, the responses are discarded. The body is buffered up to the
+// size cap and put back for the request itself.
+func (p *Proxy) mirror(s *Service, outreq *http.Request) {
+    m := s.Mirror
+    if m == nil || rand.Float64()*100 >= m.Percent {
+        return
+    }
+
+    var body []byte
+    if outreq.Body != nil && outreq.Body != http.NoBody {
+        buf, err := ioutil.ReadAll(io.LimitReader(outreq.Body, m.MaxBody+1))
+        outreq.Body = struct {
+            io.Reader
+            io.Closer
+        }{io.MultiReader(bytes.NewReader(buf), outreq.Body), outreq.Body}
+
+        if err != nil || int64(len(buf)) > m.MaxBody {
+            atomic.AddInt64(&m.stats.skipped, 1)
+            return
+        }
+        body = buf
+    }
+
+    if atomic.AddInt64(&m.stats.inFlight, 1) > maxMirrorsInFlight {
+        atomic.AddInt64(&m.stats.inFlight, -1)
+        atomic.AddInt64(&m.stats.skipped, 1)
+        return
+    }
+
+    mreq := new(http.Request)
+    *mreq = *outreq
+    u := *outreq.URL
+    mreq.URL = &u
+    mreq.Header = make(http.Header)
+    copyHeader(mreq.Header, outreq.Header)
+    mreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+    mreq.ContentLength = int64(len(body))
+
+    go p.sendMirror(s, m, mreq)
+}
+
+func (p *Proxy) sendMirror(s *Service, m *Mirror, req *http.Request) {
+    defer atomic.AddInt64(&m.stats.inFlight, -1)
+
+    transport := m.client
+    req.URL.Host = m.Host
+
+    if len(m.Pool) > 0 {
+        pool := s.pool(m.Pool)
+        var l lease
+        if pool != nil {
+            l = pool.take()
+        }
+
+        node := l.node
+        if node == nil {
+            atomic.AddInt64(&m.stats.skipped, 1)
+            return
+        }
+
+        // copies do not feed the breakers, the probe is left to real requests
+        node.circuit.cancel(l.probe)
+        defer p.decreaseConn(pool, node)
+        transport = pool.transport
+        req.URL.Host = node.Host
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.Timeout)*time.Millisecond)
+    defer cancel()
+
+    start := time.Now()
+    res, err := transport.RoundTrip(req.WithContext(ctx))
+    atomic.AddInt64(&m.stats.requests, 1)
+    atomic.AddInt64(&m.stats.latency, int64(time.Now().Sub(start)))
+
+    if err != nil {
+        atomic.AddInt64(&m.stats.errors, 1)
+        log.Printf("mirror round trip error: %v", err)
+        return
+    }
+
+    io.Copy(ioutil.Discard, res.Body)
+    res.Body.Close()
+
+    if res.StatusCode >= 500 {
+        atomic.AddInt64(&m.stats.errors, 1)
+    }
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// bodyRecorder is a backend keeping the bodies of the requests it takes.
+type bodyRecorder struct {
+    sync.Mutex
+    bodies []string
+}
+
+func (b *bodyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    body, _ := ioutil.ReadAll(r.Body)
+    b.Lock()
+    b.bodies = append(b.bodies, string(body))
+    b.Unlock()
+}
+
+func (b *bodyRecorder) get() []string {
+    b.Lock()
+    defer b.Unlock()
+
+    return append([]string(nil), b.bodies...)
+}
+
+// newMirrorProxy returns a proxy with a node of prod on primary and the mirror
+// given to the host of target.
+func newMirrorProxy(t *testing.T, primary, target http.Handler, m *Mirror) *Proxy {
+    p := newTestProxy(t, &Node{Name: "n1", Host: startBackend(t, primary), Status: "on"})
+    m.Host = startBackend(t, target)
+    validated(t, m)
+
+    if err := p.PutServiceMirror("s", m); err != nil {
+        t.Fatal(err)
+    }
+
+    return p
+}
+
+func post(p *Proxy, body string) int {
+    rw := httptest.NewRecorder()
+    p.ServeHTTP(rw, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+    return rw.Code
+}
+
+// waitMirrors waits until no copy is in flight any more.
+func waitMirrors(t *testing.T, p *Proxy) *MirrorStats {
+    for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+        st, _ := p.GetServiceMirror("s")
+        if st.Stats.InFlight == 0 {
+            return st.Stats
+        }
+    }
+
+    t.Fatal("mirrors still in flight")
+    return nil
+}
+
+func TestMirrorCopiesBody(t *testing.T) {
+    primary, target := new(bodyRecorder), new(bodyRecorder)
+    p := newMirrorProxy(t, primary, target, &Mirror{Percent: 100})
+
+    if code := post(p, "hello"); code != http.StatusOK {
+        t.Fatalf("code = %d", code)
+    }
+
+    st := waitMirrors(t, p)
+    if got := primary.get(); len(got) != 1 || got[0] != "hello" {
+        t.Errorf("bodies of the primary = %q", got)
+    }
+
+    if got := target.get(); len(got) != 1 || got[0] != "hello" || st.Requests != 1 {
+        t.Errorf("bodies of the mirror = %q, stats %+v", got, st)
+    }
+}
+
+func TestMirrorMaxBody(t *testing.T) {
+    primary, target := new(bodyRecorder), new(bodyRecorder)
+    p := newMirrorProxy(t, primary, target, &Mirror{Percent: 100, MaxBody: 4})
+
+    post(p, "hello")
+    post(p, "hi")
+    st := waitMirrors(t, p)
+
+    // the big body is not copied but reaches the primary whole
+    if got := primary.get(); len(got) != 2 || got[0] != "hello" || got[1] != "hi" {
+        t.Errorf("bodies of the primary = %q", got)
+    }
+
+    if got := target.get(); len(got) != 1 || got[0] != "hi" {
+        t.Errorf("bodies of the mirror = %q", got)
+    }
+
+    if st.Skipped != 1 || st.Requests != 1 {
+        t.Errorf("stats = %+v, want 1 skipped", st)
+    }
+}
+
+func TestMirrorSampling(t *testing.T) {
+    for _, c := range []struct {
+        percent  float64
+        min, max int64
+    }{
+        {0, 0, 0},
+        {30, 40, 80},
+        {100, 150, 200}, // copies beyond maxMirrorsInFlight are skipped
+    } {
+        p := newMirrorProxy(t, new(bodyRecorder), new(bodyRecorder), &Mirror{Percent: c.percent})
+        for i := 0; i < 200; i++ {
+            post(p, "")
+        }
+
+        if st := waitMirrors(t, p); st.Requests < c.min || st.Requests > c.max {
+            t.Errorf("copies of 200 requests at %v%% = %d", c.percent, st.Requests)
+        }
+    }
+}
+
+func TestMirrorSkipsWithoutNode(t *testing.T) {
+    p := newMirrorProxy(t, new(bodyRecorder), new(bodyRecorder), &Mirror{Percent: 100})
+    m := &Mirror{Pool: "debug", Percent: 100}
+    m.Validate()
+    p.PutServiceMirror("s", m)
+
+    post(p, "")
+    if st := waitMirrors(t, p); st.Skipped != 1 || st.Requests != 0 {
+        t.Errorf("stats = %+v, want 1 skipped for no node", st)
+    }
+}
+
+func TestMirrorClient(t *testing.T) {
+    p := newTestProxy(t)
+
+    m := &Mirror{Host: "127.0.0.1:1", Percent: 10}
+    m.Validate()
+    if m.client != nil {
+        t.Fatal("client created by Validate")
+    }
+
+    if err := p.PutServiceMirror("nope", m); err == nil || m.client != nil {
+        t.Fatalf("failed put = %v, client %v", err, m.client)
+    }
+
+    p.PutServiceMirror("s", m)
+    old := m.client
+    if old == nil {
+        t.Fatal("no client of a host mirror")
+    }
+
+    p.PutServiceMirror("s", nil)
+    if atomic.LoadInt32(&old.retired) == 0 {
+        t.Error("client of the deleted mirror not retired")
+    }
+}
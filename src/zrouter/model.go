@@ -1,57 +1,166 @@
 package main
 
 import (
+    "fmt"
     "math/rand"
-    "net/http"
-    "sort"
+    "net"
+    "regexp"
+    "time"
 )
 
 type Node struct {
-    Name    string `json:"name"`
-    Host    string `json:"host"`      // `host:port`
-    Status  string `json:"status"`    // `on/off/unloading`
-    Weight  int    `json:"weight"`    // `1 ~ 10`
-    ConnNum int    `json:"conn_num"`
+    Name     string `json:"name"`
+    Host     string `json:"host"`      // `host:port`
+    Status   string `json:"status"`    // `on/off/unloading`
+    Weight   int    `json:"weight"`    // `1 ~ 10`
+    MaxConns int    `json:"max_conns"` // max concurrent requests, 0 means no limit
+    ConnNum  int    `json:"conn_num"`
+    Version  uint64 `json:"version"`   // bumped on every change of the node, status included, see version.go
+    circuit  *circuit
+    state    *nodeState
 }
 
 type Pattern struct {
-    Type  string `json:"type"`       // `ip/header`, now only support header
-    Value string `json:"value"`      // `MyHeader`, now only support checking some header exists
+    Type     string     `json:"type"`               // `header/cookie/query/ip/method/path/host`, or `all/any/not` of the sub Patterns
+    Name     string     `json:"name,omitempty"`     // header, cookie or query parameter name, e.g. `X-Gray`
+    Op       string     `json:"op,omitempty"`       // `exists/equals/prefix/regex/in`, defaults by the operand given, always `in` of ip
+    Value    string     `json:"value,omitempty"`    // operand of `equals/prefix/regex`
+    Values   []string   `json:"values,omitempty"`   // operand of `in`, IPs and CIDR ranges of ip, e.g. `10.0.0.0/8`
+    Patterns []*Pattern `json:"patterns,omitempty"` // sub patterns of all/any/not, not takes exactly one
+    re       *regexp.Regexp
+    nets     []*net.IPNet
 }
 
 type Pool struct {
-    Pattern  *Pattern `json:"pattern"`   // request will fall into the pool if it matching the pattern of the pool, always match if Pattern is nil
-    LBPolicy string   `json:"lb_policy"` // load balance policy, now only support `random`
-    Nodes    []*Node  `json:"-"`     // request will go to one of Nodes according to the LBPolicy
+    Name           string       `json:"name"`
+    Priority       *int         `json:"priority"`        // pools of higher priority match first, the default pool only takes the rest, kept by PUT if omitted
+    Pattern        *Pattern     `json:"pattern"`         // request will fall into the pool if it matching the pattern of the pool, never match if Pattern is nil
+    LBPolicy       string       `json:"lb_policy"`       // load balance policy, now only support `random`
+    Transport      *Transport   `json:"transport"`       // connection pool tuning of the upstream transport, defaults if nil
+    Headers        *Headers     `json:"headers"`         // header rules applied after those of the service
+    MaxPending     int          `json:"max_pending"`     // max requests waiting when all nodes reach their max_conns
+    PendingTimeout int          `json:"pending_timeout"` // milliseconds a request waits for a node, 0 means 1000
+    Pending        int          `json:"pending"`         // requests waiting now
+    Stats          []*ConnStats `json:"stats,omitempty"` // upstream connection stats, filled on admin GET
+    Version        uint64       `json:"version"`         // bumped on every change of the pool config, not of its nodes
+    Nodes          []*Node      `json:"-"`               // request will go to one of Nodes according to the LBPolicy
+    transport      *poolTransport
+    traffic        *trafficStats
+    splitTraffic   *trafficStats // requests taken by the split share only, judged by rollouts
+    queue          *poolQueue
 }
 
 type Service struct {
-    Name      string `json:"name"`
-    Host      string `json:"host"`       // Host and Url represents a service
-    Url       string `json:"url"`
-    ProdPool  *Pool  `json:"-"`
-    GrayPool  *Pool  `json:"-"`
-    DebugPool *Pool  `json:"-"`
+    Name        string           `json:"name"`
+    Host        string           `json:"host"`         // Host and Url represents a service
+    Hosts       []string         `json:"hosts"`        // more hosts, `*.example.com` wildcards, `~regex` and `host:port`, see hosts.go
+    Url         string           `json:"url"`
+    Match       *Matcher         `json:"match"`        // methods, path, queries and headers the requests must match too, any if nil
+    Priority    int              `json:"priority"`     // services of the same Url are tried in descending priority
+    DefaultPool string           `json:"default_pool"` // pool taking the requests no other pool matches, `prod` by default
+    Rewrite     *Rewrite         `json:"rewrite"`      // path and host rewriting of the upstream request, none if nil
+    Redirect    *Redirect        `json:"redirect"`     // redirects every request instead of proxying, exclusive with Response
+    Response    *StaticResponse  `json:"response"`     // answers every request with a fixed response instead of proxying
+    Maintenance *Maintenance     `json:"maintenance"`  // maintenance page and the requests still let through
+    Version     uint64           `json:"version"`      // bumped by PostService and PutService
+    Pools       []*Pool          `json:"-"`            // in match order, `prod`, `gray` and `debug` are created with the service
+    Split       *Split           `json:"-"`            // share of the requests going to a pool regardless of its pattern
+    Mirror      *Mirror          `json:"-"`            // share of the requests copied to a pool or host
+    Headers     *Headers         `json:"-"`            // request and response header rules
+    RateLimits  []*RateLimit     `json:"-"`
+    Rollouts    []*RolloutStatus `json:"-"`            // recent rollouts, the last one is current
+    Promotion   *Promotion       `json:"-"`            // last promotion of canary nodes, until rolled back
+    Breaker     *Breaker         `json:"-"`            // breaker config of the service and its nodes
+    hosts       []*hostPattern
+    circuit     *circuit
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-func (p *Pattern) Match(req *http.Request) bool {
-    if p.Type == "header" {
-        for k, _ := range req.Header {
-            if req.Header.Get(k) == p.Value {
-                return true
-            }
+func newPool(name string, priority int) *Pool {
+    pool := new(Pool)
+    pool.Name = name
+    pool.Priority = &priority
+    pool.LBPolicy = "random"
+    pool.Nodes = make([]*Node, 0)
+    pool.transport = newPoolTransport(nil)
+    pool.traffic = new(trafficStats)
+    pool.splitTraffic = new(trafficStats)
+    pool.queue = newPoolQueue()
+    pool.Version = nextVersion()
+    return pool
+}
+
+func (s *Service) pool(name string) *Pool {
+    for _, pool := range s.Pools {
+        if pool.Name == name {
+            return pool
         }
     }
 
-    return false
+    return nil
+}
+
+func (s *Service) defaultPool() *Pool {
+    return s.pool(s.DefaultPool)
+}
+
+// Validate checks the configs of the service given to PostService or
+// PutService, Url defaults to `/`.
+func (s *Service) Validate() error {
+    if len(s.Url) == 0 {
+        s.Url = "/"
+    }
+
+    if s.Match != nil {
+        if err := s.Match.Validate(); err != nil {
+            return err
+        }
+    }
+
+    if err := s.parseHosts(); err != nil {
+        return err
+    }
+
+    if s.Rewrite != nil {
+        if err := s.Rewrite.Validate(); err != nil {
+            return err
+        }
+    }
+
+    if s.Maintenance != nil {
+        if err := s.Maintenance.Validate(); err != nil {
+            return err
+        }
+    }
+
+    if s.Redirect != nil && s.Response != nil {
+        return fmt.Errorf("redirect and response are exclusive")
+    }
+
+    if s.Redirect != nil {
+        if err := s.Redirect.Validate(); err != nil {
+            return err
+        }
+    }
+
+    if s.Response != nil {
+        return s.Response.Validate()
+    }
+
+    return nil
+}
+
+// available tells whether Pick may choose the node.
+func (n *Node) available(now time.Time) bool {
+    return n.Status == "on" && (n.MaxConns == 0 || n.connNum() < n.MaxConns) && n.circuit.available(now)
 }
 
 func (p *Pool) Pick() *Node {
-    available := make([]*Node, 0)
+    now := time.Now()
+    available := make([]*Node, 0, len(p.Nodes))
     for _, node := range p.Nodes {
-        if node.Status == "on" {
+        if node.available(now) {
             available = append(available, node)
         }
     }
@@ -69,38 +178,16 @@ func (p *Pool) Pick() *Node {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-type Services []*Service
-
-func (ss Services) Len() int {
-    return len(ss)
-}
-
-func (ss Services) Swap(i, j int) {
-    ss[i], ss[j] = ss[j], ss[i]
-}
-
-type ServiceReverseByUrl struct {
-    Services
-}
+type PoolsByPriority []*Pool
 
-func (s ServiceReverseByUrl) Less(i, j int) bool {
-    return s.Services[i].Url > s.Services[j].Url
+func (ps PoolsByPriority) Len() int {
+    return len(ps)
 }
 
-////////////////////////////////////////////////////////////////////////////////
-
-func findServiceByHost(services []*Service, host string) []*Service {
-    result := make([]*Service, 0)
-    for _, s := range services {
-        if s.Host == host {
-            result = append(result, s)
-        }
-    }
-
-    return result
+func (ps PoolsByPriority) Swap(i, j int) {
+    ps[i], ps[j] = ps[j], ps[i]
 }
 
-func sortServiceByUrlDsc(ss []*Service) []*Service {
-    sort.Sort(ServiceReverseByUrl{ss})
-    return ss
+func (ps PoolsByPriority) Less(i, j int) bool {
+    return *ps[i].Priority > *ps[j].Priority
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "regexp"
+    "strings"
+)
+
+// Validate checks the pattern tree and compiles its regexes and IP lists.
+// Patterns saved before header names existed only carry the header name in
+// Value, they are migrated to an `exists` check of that header.
+func (p *Pattern) Validate() error {
+    switch p.Type {
+    case "all", "any", "not":
+        return p.validateTree()
+    case "ip":
+        return p.validateIP()
+    case "header":
+        if len(p.Name) == 0 && len(p.Op) == 0 {
+            p.Name = p.Value
+            p.Value = ""
+        }
+        return p.validateValue(true)
+    case "cookie", "query":
+        return p.validateValue(true)
+    case "method", "path", "host":
+        return p.validateValue(false)
+    }
+
+    return fmt.Errorf("invalid pattern type %q", p.Type)
+}
+
+func (p *Pattern) validateTree() error {
+    if len(p.Patterns) == 0 {
+        return fmt.Errorf("empty sub patterns of %s pattern", p.Type)
+    }
+
+    if p.Type == "not" && len(p.Patterns) != 1 {
+        return fmt.Errorf("not pattern takes exactly one sub pattern")
+    }
+
+    for _, sub := range p.Patterns {
+        if sub == nil {
+            return fmt.Errorf("null sub pattern of %s pattern", p.Type)
+        }
+
+        if err := sub.Validate(); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (p *Pattern) validateIP() error {
+    if len(p.Op) == 0 {
+        p.Op = "in"
+    }
+
+    if p.Op != "in" {
+        return fmt.Errorf("invalid pattern op %q of ip", p.Op)
+    }
+
+    if len(p.Value) > 0 {
+        p.Values = append(p.Values, p.Value)
+        p.Value = ""
+    }
+
+    if len(p.Values) == 0 {
+        return fmt.Errorf("empty ip list of pattern")
+    }
+
+    nets, err := parseNets(p.Values)
+    if err != nil {
+        return err
+    }
+
+    p.nets = nets
+    return nil
+}
+
+// validateValue checks the patterns comparing some value of the request,
+// named ones pick the value of a header, cookie or query parameter.
+func (p *Pattern) validateValue(named bool) error {
+    if named && len(p.Name) == 0 {
+        return fmt.Errorf("empty %s name of pattern", p.Type)
+    }
+
+    if len(p.Op) == 0 {
+        switch {
+        case len(p.Value) > 0:
+            p.Op = "equals"
+        case len(p.Values) > 0:
+            p.Op = "in"
+        default:
+            p.Op = "exists"
+        }
+    }
+
+    if p.Type == "method" {
+        p.Value = strings.ToUpper(p.Value)
+        for i := range p.Values {
+            p.Values[i] = strings.ToUpper(p.Values[i])
+        }
+    }
+
+    if p.Type == "host" {
+        p.Value = strings.ToLower(p.Value)
+        for i := range p.Values {
+            p.Values[i] = strings.ToLower(p.Values[i])
+        }
+    }
+
+    switch p.Op {
+    case "exists":
+        if !named {
+            return fmt.Errorf("empty operand of %s pattern", p.Type)
+        }
+    case "equals", "prefix", "in":
+    case "regex":
+        re, err := regexp.Compile(p.Value)
+        if err != nil {
+            return fmt.Errorf("invalid regex of pattern: %v", err)
+        }
+        p.re = re
+    default:
+        return fmt.Errorf("invalid pattern op %q", p.Op)
+    }
+
+    return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func (p *Pattern) Match(req *http.Request) bool {
+    switch p.Type {
+    case "all":
+        for _, sub := range p.Patterns {
+            if !sub.Match(req) {
+                return false
+            }
+        }
+        return true
+    case "any":
+        for _, sub := range p.Patterns {
+            if sub.Match(req) {
+                return true
+            }
+        }
+        return false
+    case "not":
+        return !p.Patterns[0].Match(req)
+    case "ip":
+        ip := clientIP(req)
+        return ip != nil && containsIP(p.nets, ip)
+    }
+
+    values, ok := p.values(req)
+    if !ok {
+        return false
+    }
+
+    if p.Op == "exists" {
+        return true
+    }
+
+    for _, v := range values {
+        if p.matchValue(v) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// values returns the values of the request the pattern compares, false if
+// the header, cookie or query parameter is absent.
+func (p *Pattern) values(req *http.Request) ([]string, bool) {
+    switch p.Type {
+    case "header":
+        values, ok := req.Header[http.CanonicalHeaderKey(p.Name)]
+        return values, ok
+    case "cookie":
+        values := make([]string, 0)
+        for _, c := range req.Cookies() {
+            if c.Name == p.Name {
+                values = append(values, c.Value)
+            }
+        }
+        return values, len(values) > 0
+    case "query":
+        values, ok := req.URL.Query()[p.Name]
+        return values, ok
+    case "method":
+        return []string{req.Method}, true
+    case "path":
+        return []string{req.URL.Path}, true
+    case "host":
+        host := req.Host
+        if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+            host = host[0:i]
+        }
+        return []string{strings.ToLower(host)}, true
+    }
+
+    return nil, false
+}
+
+func (p *Pattern) matchValue(v string) bool {
+    switch p.Op {
+    case "equals":
+        return v == p.Value
+    case "prefix":
+        return strings.HasPrefix(v, p.Value)
+    case "regex":
+        return p.re != nil && p.re.MatchString(v)
+    case "in":
+        for _, value := range p.Values {
+            if v == value {
+                return true
+            }
+        }
+    }
+
+    return false
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestPatternHeaderOps(t *testing.T) {
+    tests := []struct {
+        pattern *Pattern
+        headers map[string]string
+        match   bool
+    }{
+        {&Pattern{Type: "header", Name: "X-Gray"}, map[string]string{"X-Gray": ""}, true},
+        {&Pattern{Type: "header", Name: "x-gray", Op: "exists"}, map[string]string{"X-Gray": "1"}, true},
+        {&Pattern{Type: "header", Name: "X-Gray"}, map[string]string{"X-Debug": "1"}, false},
+        {&Pattern{Type: "header", Name: "X-Gray", Value: "1"}, map[string]string{"X-Gray": "1"}, true},
+        {&Pattern{Type: "header", Name: "X-Gray", Op: "equals", Value: "1"}, map[string]string{"X-Gray": "10"}, false},
+        {&Pattern{Type: "header", Name: "User-Agent", Op: "prefix", Value: "curl/"}, map[string]string{"User-Agent": "curl/7.0"}, true},
+        {&Pattern{Type: "header", Name: "User-Agent", Op: "prefix", Value: "curl/"}, map[string]string{"User-Agent": "Mozilla/5.0"}, false},
+        {&Pattern{Type: "header", Name: "X-User", Op: "regex", Value: `^u\d+$`}, map[string]string{"X-User": "u42"}, true},
+        {&Pattern{Type: "header", Name: "X-User", Op: "regex", Value: `^u\d+$`}, map[string]string{"X-User": "admin"}, false},
+        {&Pattern{Type: "header", Name: "X-User", Values: []string{"alice", "bob"}}, map[string]string{"X-User": "bob"}, true},
+        {&Pattern{Type: "header", Name: "X-User", Op: "in", Values: []string{"alice", "bob"}}, map[string]string{"X-User": "eve"}, false},
+    }
+
+    for i, test := range tests {
+        p := validated(t, test.pattern)
+        req := httptest.NewRequest("GET", "/", nil)
+        for k, v := range test.headers {
+            req.Header.Set(k, v)
+        }
+
+        if got := p.Match(req); got != test.match {
+            t.Errorf("%d: %+v Match(%v) = %v, want %v", i, p, test.headers, got, test.match)
+        }
+    }
+}
+
+// The old pattern compared Value with the value of every header, so a gray
+// pattern "1" matched any request with `Content-Length: 1`.
+func TestPatternNoFalsePositiveOnOtherHeaders(t *testing.T) {
+    p := validated(t, &Pattern{Type: "header", Name: "X-Gray", Value: "1"})
+
+    req := httptest.NewRequest("POST", "/", nil)
+    req.Header.Set("Content-Length", "1")
+    req.Header.Set("X-Other", "1")
+
+    if p.Match(req) {
+        t.Errorf("pattern on X-Gray matches a request without X-Gray")
+    }
+}
+
+func TestPatternMigration(t *testing.T) {
+    p := validated(t, &Pattern{Type: "header", Value: "X-Debug"})
+    if p.Name != "X-Debug" || p.Op != "exists" || p.Value != "" {
+        t.Fatalf("migrated pattern = %+v", p)
+    }
+
+    req := httptest.NewRequest("GET", "/", nil)
+    req.Header.Set("Content-Length", "X-Debug")
+    if p.Match(req) {
+        t.Errorf("migrated pattern matches a header value")
+    }
+
+    req.Header.Set("X-Debug", "on")
+    if !p.Match(req) {
+        t.Errorf("migrated pattern does not match the header")
+    }
+}
+
+func TestPatternValidate(t *testing.T) {
+    for _, p := range []*Pattern{
+        {Type: "cookie"},
+        {Type: "path"},
+        {Type: "not"},
+        {Type: "not", Patterns: []*Pattern{{Type: "method", Value: "GET"}, {Type: "method", Value: "PUT"}}},
+        {Type: "any", Patterns: []*Pattern{{Type: "header"}}},
+        {Type: "ip"},
+        {Type: "ip", Values: []string{"10.0.0.0/33"}},
+        {Type: "header"},
+        {Type: "header", Name: "X-Gray", Op: "like"},
+        {Type: "header", Name: "X-Gray", Op: "regex", Value: "("},
+    } {
+        if err := p.Validate(); err == nil {
+            t.Errorf("Validate(%+v) = nil, want error", p)
+        }
+    }
+}
+
+func TestPatternIP(t *testing.T) {
+    p := validated(t, &Pattern{Type: "ip", Values: []string{"10.0.0.0/8", "192.168.1.7", "2001:db8::/32"}})
+
+    tests := []struct {
+        remote string
+        match  bool
+    }{
+        {"10.1.2.3:4567", true},
+        {"11.1.2.3:4567", false},
+        {"192.168.1.7:80", true},
+        {"192.168.1.8:80", false},
+        {"[2001:db8::1]:80", true},
+        {"[2001:db9::1]:80", false},
+        {"[::ffff:10.0.0.1]:80", true},
+    }
+
+    for _, test := range tests {
+        req := httptest.NewRequest("GET", "/", nil)
+        req.RemoteAddr = test.remote
+        if got := p.Match(req); got != test.match {
+            t.Errorf("Match(%s) = %v, want %v", test.remote, got, test.match)
+        }
+    }
+}
+
+func TestPatternIPForwardedFor(t *testing.T) {
+    nets, err := parseNets([]string{"172.16.0.0/12", "::1"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    defer func(saved []*net.IPNet) { trustedProxies = saved }(trustedProxies)
+    trustedProxies = nets
+
+    p := validated(t, &Pattern{Type: "ip", Values: []string{"10.0.0.0/8"}})
+
+    tests := []struct {
+        remote string
+        xff    string
+        match  bool
+    }{
+        // hops appended by trusted proxies are followed
+        {"172.16.0.1:80", "10.0.0.5", true},
+        {"[::1]:80", "10.0.0.5, 172.16.0.2", true},
+        // the client may forge the left part of the chain
+        {"172.16.0.1:80", "10.0.0.5, 8.8.8.8", false},
+        // an untrusted peer cannot claim an address
+        {"8.8.8.8:80", "10.0.0.5", false},
+    }
+
+    for _, test := range tests {
+        req := httptest.NewRequest("GET", "/", nil)
+        req.RemoteAddr = test.remote
+        req.Header.Set("X-Forwarded-For", test.xff)
+        if got := p.Match(req); got != test.match {
+            t.Errorf("Match(%s, %s) = %v, want %v", test.remote, test.xff, got, test.match)
+        }
+    }
+}
+
+func TestPatternPredicates(t *testing.T) {
+    tests := []struct {
+        pattern *Pattern
+        match   bool
+    }{
+        {&Pattern{Type: "cookie", Name: "beta", Value: "1"}, true},
+        {&Pattern{Type: "cookie", Name: "beta", Value: "2"}, false},
+        {&Pattern{Type: "cookie", Name: "alpha"}, false},
+        {&Pattern{Type: "query", Name: "v", Op: "prefix", Value: "2."}, true},
+        {&Pattern{Type: "query", Name: "debug"}, true},
+        {&Pattern{Type: "query", Name: "trace"}, false},
+        {&Pattern{Type: "method", Values: []string{"get", "head"}}, true},
+        {&Pattern{Type: "method", Value: "POST"}, false},
+        {&Pattern{Type: "path", Op: "regex", Value: `^/users/\d+$`}, true},
+        {&Pattern{Type: "path", Op: "prefix", Value: "/admin"}, false},
+        {&Pattern{Type: "host", Value: "WWW.example.com"}, true},
+        {&Pattern{Type: "host", Op: "prefix", Value: "api."}, false},
+    }
+
+    for i, test := range tests {
+        p := validated(t, test.pattern)
+        req := httptest.NewRequest("GET", "http://www.example.com:8080/users/42?v=2.1&debug", nil)
+        req.AddCookie(&http.Cookie{Name: "beta", Value: "1"})
+
+        if got := p.Match(req); got != test.match {
+            t.Errorf("%d: %+v Match = %v, want %v", i, p, got, test.match)
+        }
+    }
+}
+
+// internal IP AND cookie beta=1 OR header X-Debug present
+func TestPatternTree(t *testing.T) {
+    p := validated(t, &Pattern{Type: "any", Patterns: []*Pattern{
+        {Type: "all", Patterns: []*Pattern{
+            {Type: "ip", Values: []string{"10.0.0.0/8"}},
+            {Type: "cookie", Name: "beta", Value: "1"},
+        }},
+        {Type: "header", Name: "X-Debug"},
+    }})
+
+    tests := []struct {
+        remote string
+        beta   string
+        debug  bool
+        match  bool
+    }{
+        {"10.0.0.1:80", "1", false, true},
+        {"10.0.0.1:80", "0", false, false},
+        {"8.8.8.8:80", "1", false, false},
+        {"8.8.8.8:80", "", true, true},
+    }
+
+    for _, test := range tests {
+        req := httptest.NewRequest("GET", "/", nil)
+        req.RemoteAddr = test.remote
+        if len(test.beta) > 0 {
+            req.AddCookie(&http.Cookie{Name: "beta", Value: test.beta})
+        }
+        if test.debug {
+            req.Header.Set("X-Debug", "1")
+        }
+
+        if got := p.Match(req); got != test.match {
+            t.Errorf("Match(%+v) = %v, want %v", test, got, test.match)
+        }
+    }
+
+    not := validated(t, &Pattern{Type: "not", Patterns: []*Pattern{{Type: "method", Value: "GET"}}})
+    if not.Match(httptest.NewRequest("GET", "/", nil)) || !not.Match(httptest.NewRequest("POST", "/", nil)) {
+        t.Errorf("not pattern does not negate its sub pattern")
+    }
+}
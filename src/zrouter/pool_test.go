@@ -0,0 +1,130 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func priority(n int) *int {
+    return &n
+}
+
+func poolNames(p *Proxy) string {
+    names, _ := p.ListServicePool("s")
+    return strings.Join(names, ",")
+}
+
+func TestPoolPriorityOrder(t *testing.T) {
+    p := newTestProxy(t)
+    p.PutServicePool("s", "gray", &Pool{Priority: priority(10), LBPolicy: "random", Pattern: validated(t, &Pattern{Type: "header", Name: "X-Gray"})}, 0)
+    if err := p.PostServicePool("s", &Pool{Name: "canary", Priority: priority(15), Pattern: validated(t, &Pattern{Type: "header", Name: "X-Canary"})}); err != nil {
+        t.Fatal(err)
+    }
+
+    if names := poolNames(p); names != "debug,canary,gray,prod" {
+        t.Errorf("pools = %s, want by priority", names)
+    }
+
+    for _, c := range []struct {
+        headers []string
+        pool    string
+    }{
+        {[]string{"X-Gray", "X-Canary"}, "canary"},
+        {[]string{"X-Gray"}, "gray"},
+        {nil, "prod"},
+    } {
+        req := httptest.NewRequest("GET", "/", nil)
+        for _, h := range c.headers {
+            req.Header.Set(h, "1")
+        }
+
+        if pool, _ := p.lookupPool(p.lookup(req), req); pool.Name != c.pool {
+            t.Errorf("pool of %v = %s, want %s", c.headers, pool.Name, c.pool)
+        }
+    }
+}
+
+func TestPutServicePoolKeepsPriority(t *testing.T) {
+    p := newTestProxy(t)
+
+    in := new(Pool)
+    if err := json.Unmarshal([]byte(`{"lb_policy": "random", "max_pending": 10}`), in); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := p.PutServicePool("s", "gray", in, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    if pool, _ := p.GetServicePool("s", "gray"); *pool.Priority != 10 || pool.MaxPending != 10 {
+        t.Errorf("gray = priority %d, max_pending %d, want the priority kept", *pool.Priority, pool.MaxPending)
+    }
+
+    p.PutServicePool("s", "gray", &Pool{Priority: priority(30), LBPolicy: "random"}, 0)
+    if names := poolNames(p); names != "gray,debug,prod" {
+        t.Errorf("pools = %s, want gray first", names)
+    }
+}
+
+func TestDefaultPool(t *testing.T) {
+    p := newTestProxy(t)
+    if err := p.PostService(&Service{Name: "t", Url: "/t/", DefaultPool: "stable"}); err != nil {
+        t.Fatal(err)
+    }
+
+    req := httptest.NewRequest("GET", "/t/", nil)
+    if pool, reason := p.lookupPool(p.lookup(req), req); pool.Name != "stable" || reason != "default" {
+        t.Errorf("pool = %s by %s, want stable by default", pool.Name, reason)
+    }
+
+    if err := p.DeleteServicePool("t", "stable", 0); err == nil {
+        t.Error("default pool deleted")
+    }
+
+    if err := p.PutService(&Service{Name: "t", Url: "/t/", DefaultPool: "nope"}, 0); err == nil {
+        t.Error("default pool set to a missing pool")
+    }
+
+    if err := p.PutService(&Service{Name: "t", Url: "/t/", DefaultPool: "gray"}, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := p.DeleteServicePool("t", "stable", 0); err != nil {
+        t.Errorf("delete of the former default pool: %v", err)
+    }
+}
+
+func TestDeleteReferencedPool(t *testing.T) {
+    p := newTestProxy(t)
+    p.PostServicePool("s", &Pool{Name: "canary"})
+    p.PostServicePool("s", &Pool{Name: "verify"})
+    p.PostServicePool("s", &Pool{Name: "promoted"})
+    p.PostServicePoolNode("s", "promoted", &Node{Name: "c1", Host: "127.0.0.1:1", Status: "on"})
+
+    if err := p.PromoteService("s", "promoted", false); err != nil {
+        t.Fatal(err)
+    }
+    p.PutServiceSplit("s", &Split{Pool: "canary", Gray: 10})
+    p.PutServiceMirror("s", &Mirror{Pool: "gray", Percent: 10})
+    p.PutService(&Service{Name: "s", Url: "/", Maintenance: &Maintenance{Pool: "verify"}}, 0)
+
+    for _, pname := range []string{"canary", "gray", "verify", "promoted"} {
+        if err := p.DeleteServicePool("s", pname, 0); err == nil {
+            t.Errorf("pool %s deleted while in use", pname)
+        }
+    }
+
+    if err := p.DeleteServicePool("s", "debug", 0); err != nil {
+        t.Errorf("delete of an unused pool: %v", err)
+    }
+
+    if err := p.RollbackService("s"); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := p.DeleteServicePool("s", "promoted", 0); err != nil {
+        t.Errorf("delete of a pool rolled back: %v", err)
+    }
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "fmt"
+    "time"
+)
+
+type Promotion struct {
+    Pool     string    `json:"pool"`     // pool the promoted nodes came from
+    Unload   bool      `json:"unload"`   // old default pool nodes were put into unloading
+    Time     time.Time `json:"time"`
+    Previous []*Node   `json:"previous"` // old default pool nodes, restored by rollback
+    Promoted []*Node   `json:"promoted"` // nodes moved into the default pool
+    statuses []string  // status of the old nodes before the promotion
+}
+
+// promote swaps the nodes of a canary pool, `gray` usually, into the default
+// pool in one step, the old nodes are kept aside for rollback. With unload
+// they go unloading, so that they turn off once their in-flight requests
+// finish. The caller holds the proxy lock.
+func (s *Service) promote(pname string, unload bool) error {
+    from, to := s.pool(pname), s.defaultPool()
+    if from == nil || to == nil {
+        return fmt.Errorf("pool %s or default pool of service %s not found", pname, s.Name)
+    }
+
+    if from == to {
+        return fmt.Errorf("pool %s is the default pool of service %s", pname, s.Name)
+    }
+
+    if len(from.Nodes) == 0 {
+        return fmt.Errorf("no node in pool %s of service %s", pname, s.Name)
+    }
+
+    pr := &Promotion{
+        Pool:     pname,
+        Unload:   unload,
+        Time:     time.Now(),
+        Previous: to.Nodes,
+        Promoted: from.Nodes,
+        statuses: make([]string, len(to.Nodes)),
+    }
+
+    for i, node := range pr.Previous {
+        pr.statuses[i] = node.Status
+        if unload && node.Status == "on" {
+            node.setStatus("unloading")
+        }
+
+        to.transport.forget(node.Host)
+    }
+
+    to.Nodes = pr.Promoted
+    from.Nodes = make([]*Node, 0)
+    s.Promotion = pr
+    s.Split = nil
+    return nil
+}
+
+// rollback restores the default pool nodes of the last promotion and moves
+// the promoted nodes back into their pool. The caller holds the proxy lock.
+func (s *Service) rollback() error {
+    pr := s.Promotion
+    if pr == nil {
+        return fmt.Errorf("no promotion of service %s", s.Name)
+    }
+
+    from, to := s.pool(pr.Pool), s.defaultPool()
+    if from == nil || to == nil {
+        return fmt.Errorf("pool %s or default pool of service %s not found", pr.Pool, s.Name)
+    }
+
+    for _, node := range to.Nodes {
+        for _, other := range from.Nodes {
+            if other.Name == node.Name {
+                return fmt.Errorf("duplicate node %s in pool %s", node.Name, pr.Pool)
+            }
+        }
+    }
+
+    for i, node := range pr.Previous {
+        node.setStatus(pr.statuses[i])
+    }
+
+    for _, node := range to.Nodes {
+        to.transport.forget(node.Host)
+    }
+
+    from.Nodes = append(from.Nodes, to.Nodes...)
+    to.Nodes = pr.Previous
+    s.Promotion = nil
+    return nil
+}
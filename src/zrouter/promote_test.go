@@ -0,0 +1,134 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func newPromoteProxy(t *testing.T) *Proxy {
+    p := newTestProxy(t, &Node{Name: "p1", Host: "127.0.0.1:1", Status: "on"}, &Node{Name: "p2", Host: "127.0.0.1:2", Status: "off"})
+    addNode(t, p, "gray", &Node{Name: "g1", Host: "127.0.0.1:3", Status: "on"})
+    return p
+}
+
+func poolNodes(p *Proxy, pname string) string {
+    nodes, _ := p.ListServicePoolNode("s", pname)
+    names := make([]string, len(nodes))
+    for i, node := range nodes {
+        names[i] = node.Name + ":" + node.Status
+    }
+
+    return strings.Join(names, ",")
+}
+
+func TestPromoteSwapsNodes(t *testing.T) {
+    p := newPromoteProxy(t)
+
+    if err := p.PromoteService("s", "gray", false); err != nil {
+        t.Fatal(err)
+    }
+
+    if nodes := poolNodes(p, "prod"); nodes != "g1:on" {
+        t.Errorf("prod nodes = %s, want g1:on", nodes)
+    }
+
+    if nodes := poolNodes(p, "gray"); nodes != "" {
+        t.Errorf("gray nodes = %s, want none", nodes)
+    }
+
+    pr, err := p.GetServicePromotion("s")
+    if err != nil || pr.Pool != "gray" || len(pr.Previous) != 2 || len(pr.Promoted) != 1 {
+        t.Fatalf("promotion = %+v, %v", pr, err)
+    }
+
+    // requests go to the promoted nodes at once
+    if s := p.Services[0]; s.defaultPool().Pick().Name != "g1" {
+        t.Error("prod does not pick the promoted node")
+    }
+}
+
+func TestPromoteUnloads(t *testing.T) {
+    p := newPromoteProxy(t)
+    p.PutServicePoolNode("s", "prod", &Node{Name: "p2", Status: "on"}, 0)
+
+    p1 := p.Services[0].defaultPool().Nodes[0]
+    if !p1.take() {
+        t.Fatal("take failed")
+    }
+
+    if err := p.PromoteService("s", "gray", true); err != nil {
+        t.Fatal(err)
+    }
+
+    // p1 finishes its request first, p2 is idle and turns off at once
+    pr, _ := p.GetServicePromotion("s")
+    if pr.Previous[0].Status != "unloading" || pr.Previous[1].Status != "off" {
+        t.Errorf("old prod nodes = %s, %s, want unloading, off", pr.Previous[0].Status, pr.Previous[1].Status)
+    }
+
+    // p1 is no longer in any pool, its last request still turns it off
+    p.decreaseConn(p.Services[0].defaultPool(), p1)
+    if pr, _ := p.GetServicePromotion("s"); pr.Previous[0].Status != "off" {
+        t.Errorf("p1 after its last request = %s, want off", pr.Previous[0].Status)
+    }
+}
+
+func TestRollbackRestores(t *testing.T) {
+    p := newPromoteProxy(t)
+
+    if err := p.PromoteService("s", "gray", true); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := p.RollbackService("s"); err != nil {
+        t.Fatal(err)
+    }
+
+    if nodes := poolNodes(p, "prod"); nodes != "p1:on,p2:off" {
+        t.Errorf("prod nodes = %s, want the statuses before the promotion", nodes)
+    }
+
+    if nodes := poolNodes(p, "gray"); nodes != "g1:on" {
+        t.Errorf("gray nodes = %s, want g1 back", nodes)
+    }
+
+    if _, err := p.GetServicePromotion("s"); err == nil {
+        t.Error("promotion kept after the rollback")
+    }
+
+    if err := p.RollbackService("s"); err == nil || !strings.Contains(err.Error(), "no promotion") {
+        t.Errorf("second rollback = %v, want no promotion", err)
+    }
+}
+
+func TestRollbackDuplicateNode(t *testing.T) {
+    p := newPromoteProxy(t)
+
+    if err := p.PromoteService("s", "gray", false); err != nil {
+        t.Fatal(err)
+    }
+
+    p.PostServicePoolNode("s", "gray", &Node{Name: "g1", Host: "127.0.0.1:4", Status: "on"})
+    if err := p.RollbackService("s"); err == nil || !strings.Contains(err.Error(), "duplicate node g1") {
+        t.Fatalf("rollback = %v, want duplicate node", err)
+    }
+
+    // nothing is changed by the failed rollback
+    if nodes := poolNodes(p, "prod"); nodes != "g1:on" {
+        t.Errorf("prod nodes = %s, want g1:on", nodes)
+    }
+}
+
+func TestPromoteErrors(t *testing.T) {
+    p := newTestProxy(t, &Node{Name: "p1", Host: "127.0.0.1:1", Status: "on"})
+
+    for _, pname := range []string{"gray", "prod", "nope"} {
+        if err := p.PromoteService("s", pname, false); err == nil {
+            t.Errorf("promotion of pool %s succeeded", pname)
+        }
+    }
+
+    if err := p.RollbackService("s"); err == nil {
+        t.Error("rollback without promotion succeeded")
+    }
+}
@@ -6,20 +6,32 @@ import (
     "log"
     "net"
     "net/http"
-    "strings"
+    "sort"
     "sync"
+    "sync/atomic"
+    "time"
 )
 
 type Proxy struct {
     sync.Mutex
     Services []*Service
+    routes   atomic.Value    // *routeTable of the copy of Services published, see publish
+    counters *sharedCounters // shared rate limit counters, local buckets only if nil
+    second   time.Duration   // unit of rollout intervals, shorter in tests
 }
 
 var proxy *Proxy
 
 func init() {
-    proxy = new(Proxy)
-    proxy.Services = make([]*Service, 0)
+    proxy = newProxy()
+}
+
+func newProxy() *Proxy {
+    p := new(Proxy)
+    p.Services = make([]*Service, 0)
+    p.second = time.Second
+    p.publish()
+    return p
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -40,16 +52,12 @@ func (p *Proxy) getServicePool(sname, pname string) (*Pool, error) {
         return nil, err
     }
 
-    switch pname {
-    case "prod":
-        return service.ProdPool, nil
-    case "gray":
-        return service.GrayPool, nil
-    case "debug":
-        return service.DebugPool, nil
+    pool := service.pool(pname)
+    if pool == nil {
+        return nil, fmt.Errorf("pool %s not found", pname)
     }
 
-    return nil, fmt.Errorf("pool %s not found", pname)
+    return pool, nil
 }
 
 func (p *Proxy) getServicePoolNode(sname, pname, nname string) (*Node, error) {
@@ -71,26 +79,37 @@ func (p *Proxy) ListService() []*Service {
     p.Lock()
     defer p.Unlock()
 
-    return p.Services
+    services := make([]*Service, len(p.Services))
+    for i, s := range p.Services {
+        services[i] = s.view()
+    }
+
+    return services
 }
 
 func (p *Proxy) PostService(service *Service) error {
     p.Lock()
     defer p.Unlock()
+    defer p.publish()
 
+    return p.postService(service)
+}
+
+func (p *Proxy) postService(service *Service) error {
     if _, err := p.getService(service.Name); err == nil {
         return fmt.Errorf("duplicate service %s", service.Name)
     }
 
-    service.ProdPool = new(Pool)
-    service.ProdPool.LBPolicy = "random"
-    service.ProdPool.Nodes = make([]*Node, 0)
-    service.GrayPool = new(Pool)
-    service.GrayPool.LBPolicy = "random"
-    service.GrayPool.Nodes = make([]*Node, 0)
-    service.DebugPool = new(Pool)
-    service.DebugPool.LBPolicy = "random"
-    service.DebugPool.Nodes = make([]*Node, 0)
+    service.Pools = []*Pool{newPool("debug", 20), newPool("gray", 10), newPool("prod", 0)}
+    if service.defaultPool() == nil {
+        service.Pools = append(service.Pools, newPool(service.DefaultPool, 0))
+    }
+
+    if m := service.Maintenance; m != nil && service.pool(m.Pool) == nil {
+        return fmt.Errorf("pool %s not found", m.Pool)
+    }
+    service.circuit = newCircuit(nil)
+    service.Version = nextVersion()
 
     p.Services = append(p.Services, service)
     return nil
@@ -100,26 +119,61 @@ func (p *Proxy) GetService(name string) (*Service, error) {
     p.Lock()
     defer p.Unlock()
 
-    return p.getService(name)
+    s, err := p.getService(name)
+    if err != nil {
+        return nil, err
+    }
+
+    return s.view(), nil
 }
 
-func (p *Proxy) PutService(service *Service) error {
+func (p *Proxy) PutService(service *Service, versions ...uint64) error {
     p.Lock()
     defer p.Unlock()
+    defer p.publish()
 
+    return p.putService(service, versions...)
+}
+
+func (p *Proxy) putService(service *Service, versions ...uint64) error {
     s, err := p.getService(service.Name)
     if err != nil {
         return err
     }
 
+    if err := checkVersion("service "+s.Name, s.Version, versions); err != nil {
+        return err
+    }
+
+    if m := service.Maintenance; m != nil && s.pool(m.Pool) == nil {
+        return fmt.Errorf("pool %s not found", m.Pool)
+    }
+
+    if len(service.DefaultPool) > 0 {
+        if s.pool(service.DefaultPool) == nil {
+            return fmt.Errorf("pool %s not found", service.DefaultPool)
+        }
+        s.DefaultPool = service.DefaultPool
+    }
+
     s.Host = service.Host
+    s.Hosts = service.Hosts
+    s.hosts = service.hosts
     s.Url = service.Url
+    s.Match = service.Match
+    s.Priority = service.Priority
+    s.Rewrite = service.Rewrite
+    s.Redirect = service.Redirect
+    s.Response = service.Response
+    s.Maintenance = service.Maintenance
+    s.Version = nextVersion()
     return nil
 }
 
-func (p *Proxy) DeleteService(name string) error {
+func (p *Proxy) DeleteService(name string, versions ...uint64) error {
     p.Lock()
     defer p.Unlock()
+    defer p.publish()
 
     var i int
     for i = 0; i < len(p.Services); i++ {
@@ -132,63 +186,175 @@ func (p *Proxy) DeleteService(name string) error {
         return fmt.Errorf("service %s not found", name)
     }
 
+    if err := checkVersion("service "+name, p.Services[i].Version, versions); err != nil {
+        return err
+    }
+
+    s := p.Services[i]
+    s.stopRollout("service deleted")
+    for _, pool := range s.Pools {
+        pool.transport.retire()
+    }
+
+    if s.Mirror != nil && s.Mirror.client != nil {
+        s.Mirror.client.retire()
+    }
+
     p.Services = append(p.Services[:i], p.Services[i+1:]...)
     return nil
 }
 
+// ListServicePool returns the pool names in match order, by descending
+// priority and creation order of equal priorities, `debug,gray,prod` for a
+// new service. It listed `prod,gray,debug` before pools had priorities.
 func (p *Proxy) ListServicePool(sname string) ([]string, error) {
     p.Lock()
     defer p.Unlock()
 
-    if _, err := p.getService(sname); err != nil {
+    service, err := p.getService(sname)
+    if err != nil {
         return nil, err
     }
 
-    return []string{"prod", "gray", "debug"}, nil
+    names := make([]string, 0, len(service.Pools))
+    for _, pool := range service.Pools {
+        names = append(names, pool.Name)
+    }
+
+    return names, nil
+}
+
+func (p *Proxy) PostServicePool(sname string, pl *Pool) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    if service.pool(pl.Name) != nil {
+        return fmt.Errorf("duplicate pool %s", pl.Name)
+    }
+
+    priority := 0
+    if pl.Priority != nil {
+        priority = *pl.Priority
+    }
+
+    pool := newPool(pl.Name, priority)
+    pool.Pattern = pl.Pattern
+    pool.LBPolicy = pl.LBPolicy
+    pool.Headers = pl.Headers
+    pool.MaxPending = pl.MaxPending
+    pool.PendingTimeout = pl.PendingTimeout
+    pool.Transport = pl.Transport
+    pool.transport = newPoolTransport(pl.Transport)
+
+    service.Pools = append(service.Pools, pool)
+    sort.Stable(PoolsByPriority(service.Pools))
+    return nil
 }
 
 func (p *Proxy) GetServicePool(sname, pname string) (*Pool, error) {
     p.Lock()
     defer p.Unlock()
 
-    return p.getServicePool(sname, pname)
+    pool, err := p.getServicePool(sname, pname)
+    if err != nil {
+        return nil, err
+    }
+
+    return pool.view(), nil
 }
 
-func (p *Proxy) PutServicePool(sname, pname string, pl *Pool) error {
+func (p *Proxy) PutServicePool(sname, pname string, pl *Pool, versions ...uint64) error {
     p.Lock()
     defer p.Unlock()
+    defer p.publish()
 
     pool, err := p.getServicePool(sname, pname)
     if err != nil {
         return err
     }
 
+    if err := checkVersion("pool "+pname, pool.Version, versions); err != nil {
+        return err
+    }
+
+    service, _ := p.getService(sname)
+
+    if pl.Priority != nil {
+        pool.Priority = pl.Priority
+    }
     pool.Pattern = pl.Pattern
     pool.LBPolicy = pl.LBPolicy
+    pool.Headers = pl.Headers
+    pool.MaxPending = pl.MaxPending
+    pool.PendingTimeout = pl.PendingTimeout
+    sort.Stable(PoolsByPriority(service.Pools))
+
+    if !sameTransport(pool.Transport, pl.Transport) {
+        pool.transport.retire()
+        pool.transport = newPoolTransport(pl.Transport)
+        pool.Transport = pl.Transport
+    }
 
+    pool.Version = nextVersion()
     return nil
 }
 
-func (p *Proxy) DeleteServicePool(sname, pname string) error {
+func (p *Proxy) DeleteServicePool(sname, pname string, versions ...uint64) error {
     p.Lock()
     defer p.Unlock()
+    defer p.publish()
 
     service, err := p.getService(sname)
     if err != nil {
         return err
     }
 
-    switch pname {
-    case "prod":
-        service.ProdPool = nil
-    case "gray":
-        service.GrayPool = nil
-    case "debug":
-        service.DebugPool = nil
-    default:
+    if pname == service.DefaultPool {
+        return fmt.Errorf("pool %s is the default pool of service %s", pname, sname)
+    }
+
+    // requests sent to a deleted pool would fail
+    if m := service.Maintenance; m != nil && m.Pool == pname {
+        return fmt.Errorf("pool %s is the maintenance pool of service %s", pname, sname)
+    }
+
+    if service.Split != nil && service.Split.Pool == pname {
+        return fmt.Errorf("pool %s is the split pool of service %s", pname, sname)
+    }
+
+    if service.Mirror != nil && service.Mirror.Pool == pname {
+        return fmt.Errorf("pool %s is the mirror pool of service %s", pname, sname)
+    }
+
+    // rollback moves the promoted nodes back into it
+    if service.Promotion != nil && service.Promotion.Pool == pname {
+        return fmt.Errorf("pool %s has a promotion of service %s pending", pname, sname)
+    }
+
+    old := service.pool(pname)
+    if old == nil {
         return fmt.Errorf("pool %s not found", pname)
     }
 
+    if err := checkVersion("pool "+pname, old.Version, versions); err != nil {
+        return err
+    }
+
+    pools := make([]*Pool, 0, len(service.Pools))
+    for _, pool := range service.Pools {
+        if pool != old {
+            pools = append(pools, pool)
+        }
+    }
+
+    old.transport.retire()
+    service.Pools = pools
     return nil
 }
 
@@ -201,13 +367,18 @@ func (p *Proxy) ListServicePoolNode(sname, pname string) ([]*Node, error) {
         return nil, err
     }
 
-    return pool.Nodes, nil
+    return viewNodes(pool.Nodes), nil
 }
 
 func (p *Proxy) PostServicePoolNode(sname, pname string, n *Node) error {
     p.Lock()
     defer p.Unlock()
+    defer p.publish()
+
+    return p.postServicePoolNode(sname, pname, n)
+}
 
+func (p *Proxy) postServicePoolNode(sname, pname string, n *Node) error {
     pool, err := p.getServicePool(sname, pname)
     if err != nil {
         return err
@@ -217,6 +388,11 @@ func (p *Proxy) PostServicePoolNode(sname, pname string, n *Node) error {
         return fmt.Errorf("duplicate node %s", n.Name)
     }
 
+    service, _ := p.getService(sname)
+    n.circuit = newCircuit(service.Breaker)
+    n.state = new(nodeState)
+    n.Version = nextVersion()
+
     if pool.Nodes == nil {
         pool.Nodes = make([]*Node, 0)
     }
@@ -229,37 +405,61 @@ func (p *Proxy) GetServicePoolNode(sname, pname, nname string) (*Node, error) {
     p.Lock()
     defer p.Unlock()
 
-    return p.getServicePoolNode(sname, pname, nname)
+    node, err := p.getServicePoolNode(sname, pname, nname)
+    if err != nil {
+        return nil, err
+    }
+
+    return node.view(), nil
 }
 
-func (p *Proxy) PutServicePoolNode(sname, pname string, n *Node) error {
+func (p *Proxy) PutServicePoolNode(sname, pname string, n *Node, versions ...uint64) error {
     p.Lock()
     defer p.Unlock()
+    defer p.publish()
 
+    return p.putServicePoolNode(sname, pname, n, versions...)
+}
+
+func (p *Proxy) putServicePoolNode(sname, pname string, n *Node, versions ...uint64) error {
     node, err := p.getServicePoolNode(sname, pname, n.Name)
     if err != nil {
         return err
     }
 
-    node.Weight = n.Weight
-    node.Status = n.Status
-
-    if node.Status == "unloading" && node.ConnNum == 0 {
-        node.Status = "off"
+    if err := checkVersion("node "+n.Name, node.Version, versions); err != nil {
+        return err
     }
 
+    node.Weight = n.Weight
+    node.MaxConns = n.MaxConns
+    node.setStatus(n.Status)
+    node.Version = nextVersion()
     return nil
 }
 
-func (p *Proxy) DeleteServicePoolNode(sname, pname, nname string) error {
+func (p *Proxy) DeleteServicePoolNode(sname, pname, nname string, versions ...uint64) error {
     p.Lock()
     defer p.Unlock()
+    defer p.publish()
 
-    pool, err := p.getServicePool(sname, pname)
+    pool, node, err := p.deleteServicePoolNode(sname, pname, nname, versions...)
     if err != nil {
         return err
     }
 
+    pool.transport.forget(node.Host)
+    return nil
+}
+
+// deleteServicePoolNode removes the node from the pool and returns them, the
+// caller forgets the connections to the node.
+func (p *Proxy) deleteServicePoolNode(sname, pname, nname string, versions ...uint64) (*Pool, *Node, error) {
+    pool, err := p.getServicePool(sname, pname)
+    if err != nil {
+        return nil, nil, err
+    }
+
     var i int
     for i = 0; i < len(pool.Nodes); i++ {
         if pool.Nodes[i].Name == nname {
@@ -268,101 +468,550 @@ func (p *Proxy) DeleteServicePoolNode(sname, pname, nname string) error {
     }
 
     if i == len(pool.Nodes) {
-        return fmt.Errorf("node %s not found", nname)
+        return nil, nil, fmt.Errorf("node %s not found", nname)
+    }
+
+    node := pool.Nodes[i]
+    if err := checkVersion("node "+nname, node.Version, versions); err != nil {
+        return nil, nil, err
     }
 
     pool.Nodes = append(pool.Nodes[:i], pool.Nodes[i+1:]...)
+    return pool, node, nil
+}
+
+func (p *Proxy) getServiceRateLimit(sname, rname string) (*RateLimit, error) {
+    service, err := p.getService(sname)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, r := range service.RateLimits {
+        if r.Name == rname {
+            return r, nil
+        }
+    }
+
+    return nil, fmt.Errorf("rate limit %s not found", rname)
+}
+
+func (p *Proxy) ListServiceRateLimit(sname string) ([]*RateLimit, error) {
+    p.Lock()
+    defer p.Unlock()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return nil, err
+    }
+
+    return service.RateLimits, nil
+}
+
+func (p *Proxy) PostServiceRateLimit(sname string, r *RateLimit) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    if _, err := p.getServiceRateLimit(sname, r.Name); err == nil {
+        return fmt.Errorf("duplicate rate limit %s", r.Name)
+    }
+
+    // rate limits are read by ServeHTTP without the lock, never modify the slice in place
+    limits := make([]*RateLimit, 0, len(service.RateLimits)+1)
+    service.RateLimits = append(append(limits, service.RateLimits...), r)
     return nil
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func (p *Proxy) GetServiceRateLimit(sname, rname string) (*RateLimit, error) {
+    p.Lock()
+    defer p.Unlock()
 
-func (p *Proxy) lookupService(req *http.Request) *Service {
-    host := req.Host
-    if i := strings.Index(host, ":"); i >= 0 {
-        host = host[0:i]
+    return p.getServiceRateLimit(sname, rname)
+}
+
+func (p *Proxy) PutServiceRateLimit(sname string, r *RateLimit) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
     }
 
-    path := req.URL.Path
-    ss := findServiceByHost(p.Services, host)
-    if len(ss) == 0 {
-        ss = findServiceByHost(p.Services, "")
-        if len(ss) == 0 {
+    limits := make([]*RateLimit, len(service.RateLimits))
+    for i, old := range service.RateLimits {
+        if old.Name == r.Name {
+            r.inherit(old)
+            copy(limits, service.RateLimits)
+            limits[i] = r
+            service.RateLimits = limits
             return nil
         }
     }
 
-    for _, s := range sortServiceByUrlDsc(ss) {
-        if strings.HasPrefix(path, s.Url) {
-            return s
+    return fmt.Errorf("rate limit %s not found", r.Name)
+}
+
+func (p *Proxy) DeleteServiceRateLimit(sname, rname string) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    limits := make([]*RateLimit, 0, len(service.RateLimits))
+    for _, r := range service.RateLimits {
+        if r.Name != rname {
+            limits = append(limits, r)
         }
     }
 
+    if len(limits) == len(service.RateLimits) {
+        return fmt.Errorf("rate limit %s not found", rname)
+    }
+
+    service.RateLimits = limits
     return nil
 }
 
-func (p *Proxy) lookupNode(s *Service, req *http.Request) *Node {
-    for _, pool := range []*Pool{s.DebugPool, s.GrayPool} {
-        if pool.Pattern != nil && pool.Pattern.Match(req) {
-            return pool.Pick()
+func (p *Proxy) GetServiceSplit(sname string) (*Split, error) {
+    p.Lock()
+    defer p.Unlock()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return nil, err
+    }
+
+    if service.Split == nil {
+        return new(Split), nil
+    }
+
+    return service.Split, nil
+}
+
+func (p *Proxy) PutServiceSplit(sname string, split *Split) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    // the rollout steps the split, it would overwrite the change
+    if st := service.rollout(); st != nil && st.State == "running" {
+        return fmt.Errorf("rollout of service %s is running", sname)
+    }
+
+    if split != nil && service.pool(split.Pool) == nil {
+        return fmt.Errorf("pool %s not found", split.Pool)
+    }
+
+    service.Split = split
+    return nil
+}
+
+func (p *Proxy) ListServiceRollout(sname string) ([]*RolloutStatus, error) {
+    p.Lock()
+    defer p.Unlock()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return nil, err
+    }
+
+    rollouts := make([]*RolloutStatus, len(service.Rollouts))
+    for i, st := range service.Rollouts {
+        rollouts[i] = st.view()
+    }
+
+    return rollouts, nil
+}
+
+func (p *Proxy) PostServiceRollout(sname string, r *Rollout) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    if st := service.rollout(); st != nil && st.State == "running" {
+        return fmt.Errorf("rollout of service %s is running", sname)
+    }
+
+    if pool := service.pool(r.Pool); pool == nil || !pool.serving() {
+        return fmt.Errorf("no node of pool %s is on", r.Pool)
+    }
+
+    st := &RolloutStatus{Rollout: r, State: "running", Started: time.Now(), History: make([]*RolloutStep, 0), split: service.Split, stop: make(chan struct{})}
+    service.Rollouts = append(service.Rollouts, st)
+    if len(service.Rollouts) > maxRollouts {
+        service.Rollouts = service.Rollouts[len(service.Rollouts)-maxRollouts:]
+    }
+
+    go p.runRollout(service, st)
+    return nil
+}
+
+func (p *Proxy) GetServiceRollout(sname string) (*RolloutStatus, error) {
+    p.Lock()
+    defer p.Unlock()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return nil, err
+    }
+
+    st := service.rollout()
+    if st == nil {
+        return nil, fmt.Errorf("no rollout of service %s", sname)
+    }
+
+    return st.view(), nil
+}
+
+func (p *Proxy) DeleteServiceRollout(sname string) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    st := service.rollout()
+    if st == nil || st.State != "running" {
+        return fmt.Errorf("no running rollout of service %s", sname)
+    }
+
+    service.finish(st, "aborted", "aborted by admin")
+    return nil
+}
+
+func (p *Proxy) GetServicePromotion(sname string) (*Promotion, error) {
+    p.Lock()
+    defer p.Unlock()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return nil, err
+    }
+
+    if service.Promotion == nil {
+        return nil, fmt.Errorf("no promotion of service %s", sname)
+    }
+
+    return service.Promotion.view(), nil
+}
+
+func (p *Proxy) PromoteService(sname, pname string, unload bool) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    if st := service.rollout(); st != nil && st.State == "running" {
+        return fmt.Errorf("rollout of service %s is running", sname)
+    }
+
+    return service.promote(pname, unload)
+}
+
+func (p *Proxy) RollbackService(sname string) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    return service.rollback()
+}
+
+func (p *Proxy) GetServiceMirror(sname string) (*MirrorStatus, error) {
+    p.Lock()
+    defer p.Unlock()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return nil, err
+    }
+
+    if service.Mirror == nil {
+        return nil, fmt.Errorf("no mirror of service %s", sname)
+    }
+
+    return &MirrorStatus{Config: service.Mirror, Stats: service.Mirror.Stats()}, nil
+}
+
+func (p *Proxy) PutServiceMirror(sname string, m *Mirror) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    if m != nil && len(m.Pool) > 0 && service.pool(m.Pool) == nil {
+        return fmt.Errorf("pool %s not found", m.Pool)
+    }
+
+    if old := service.Mirror; old != nil && old.client != nil {
+        old.client.retire()
+    }
+
+    if m != nil && len(m.Host) > 0 {
+        m.client = newPoolTransport(nil)
+    }
+
+    service.Mirror = m
+    return nil
+}
+
+func (p *Proxy) GetServiceHeaders(sname string) (*Headers, error) {
+    p.Lock()
+    defer p.Unlock()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return nil, err
+    }
+
+    if service.Headers == nil {
+        return new(Headers), nil
+    }
+
+    return service.Headers, nil
+}
+
+func (p *Proxy) PutServiceHeaders(sname string, h *Headers) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    service.Headers = h
+    return nil
+}
+
+func (p *Proxy) GetServiceBreaker(sname string) (*BreakerStatus, error) {
+    p.Lock()
+    defer p.Unlock()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return nil, err
+    }
+
+    return service.circuit.Status(), nil
+}
+
+func (p *Proxy) PutServiceBreaker(sname string, b *Breaker) error {
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    service.Breaker = b
+    service.circuit.configure(b)
+    for _, pool := range service.Pools {
+        for _, node := range pool.Nodes {
+            node.circuit.configure(b)
         }
     }
 
-    return s.ProdPool.Pick()
+    return nil
 }
 
-func (p *Proxy) lookup(req *http.Request) *Node {
+func (p *Proxy) TripServiceBreaker(sname string) error {
     p.Lock()
     defer p.Unlock()
 
-    s := p.lookupService(req)
-    if s == nil {
-        return nil
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    service.circuit.trip()
+    return nil
+}
+
+func (p *Proxy) ResetServiceBreaker(sname string) error {
+    p.Lock()
+    defer p.Unlock()
+
+    service, err := p.getService(sname)
+    if err != nil {
+        return err
+    }
+
+    service.circuit.reset()
+    return nil
+}
+
+func (p *Proxy) GetServicePoolNodeBreaker(sname, pname, nname string) (*BreakerStatus, error) {
+    p.Lock()
+    defer p.Unlock()
+
+    node, err := p.getServicePoolNode(sname, pname, nname)
+    if err != nil {
+        return nil, err
     }
 
-    return p.lookupNode(s, req)
+    return node.circuit.Status(), nil
 }
 
-func (p *Proxy) increaseConn(node *Node) {
+func (p *Proxy) TripServicePoolNodeBreaker(sname, pname, nname string) error {
     p.Lock()
     defer p.Unlock()
 
-    node.ConnNum++
+    node, err := p.getServicePoolNode(sname, pname, nname)
+    if err != nil {
+        return err
+    }
+
+    node.circuit.trip()
+    return nil
 }
 
-func (p *Proxy) decreaseConn(node *Node) {
+func (p *Proxy) ResetServicePoolNodeBreaker(sname, pname, nname string) error {
     p.Lock()
     defer p.Unlock()
+    defer p.publish()
+
+    node, err := p.getServicePoolNode(sname, pname, nname)
+    if err != nil {
+        return err
+    }
+
+    node.circuit.reset()
+    return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
 
-    node.ConnNum--
+// lookupPool returns the pool taking the request and why, one of
+// `maintenance/pattern/split/default`.
+func (p *Proxy) lookupPool(s *Service, req *http.Request) (*Pool, string) {
+    if m := s.Maintenance; m != nil && m.Enabled {
+        return s.pool(m.Pool), "maintenance"
+    }
 
-    if node.ConnNum == 0 && node.Status == "unloading" {
-        node.Status = "off"
+    for _, pool := range s.Pools {
+        if pool.Name != s.DefaultPool && pool.Pattern != nil && pool.Pattern.Match(req) {
+            return pool, "pattern"
+        }
     }
+
+    if s.Split != nil {
+        if pool := s.pool(s.Split.Pool); pool != nil && pool.serving() && s.Split.gray(req) {
+            return pool, "split"
+        }
+    }
+
+    return s.defaultPool(), "default"
+}
+
+func (p *Proxy) lookup(req *http.Request) *Service {
+    return p.routes.Load().(*routeTable).lookup(req)
 }
 
 func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-    node := p.lookup(req)
+    s := p.lookup(req)
+    if s == nil {
+        rw.WriteHeader(http.StatusNotFound)
+        return
+    }
+
+    if p.maintain(s, rw, req) {
+        return
+    }
+
+    if !p.limit(s, rw, req) {
+        return
+    }
+
+    if p.respond(s, rw, req) {
+        return
+    }
+
+    ok, sprobe := s.circuit.allow(time.Now())
+    if !ok {
+        rw.WriteHeader(http.StatusServiceUnavailable)
+        return
+    }
+
+    pool, reason := p.lookupPool(s, req)
+    l, err := p.acquire(pool, req)
+    if err != nil {
+        s.circuit.cancel(sprobe)
+    }
+
+    if err == errBusy {
+        rw.WriteHeader(http.StatusServiceUnavailable)
+        return
+    }
+
+    node := l.node
     if node == nil {
         rw.WriteHeader(http.StatusNotFound)
         return
     }
 
-    p.increaseConn(node)
-    defer p.decreaseConn(node)
+    defer p.decreaseConn(pool, node)
 
     outreq := new(http.Request)
     *outreq = *req
 
+    u := *req.URL
+    outreq.URL = &u
     outreq.URL.Scheme = "http"
     outreq.URL.Host = node.Host
 
+    if s.Rewrite != nil {
+        s.Rewrite.apply(outreq.URL, s.Url)
+        outreq.Host = s.Rewrite.host(req.Host, node)
+    }
+
     outreq.Proto = "HTTP/1.1"
     outreq.ProtoMajor = 1
     outreq.ProtoMinor = 1
     outreq.Close = false
 
-    if outreq.Header.Get("Connection") != "" {
+    reqRules, resRules := headerRules(s, pool, false), headerRules(s, pool, true)
+
+    if outreq.Header.Get("Connection") != "" || len(reqRules) > 0 {
         outreq.Header = make(http.Header)
         copyHeader(outreq.Header, req.Header)
         outreq.Header.Del("Connection")
@@ -372,13 +1021,30 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
         outreq.Header.Set("X-Forwarded-For", clientIp)
     }
 
-    res, err := http.DefaultTransport.RoundTrip(outreq)
+    vars := &headerVars{req: req, service: s.Name, pool: pool.Name, node: node.Name}
+    rewriteHeader(outreq.Header, reqRules, vars)
+
+    p.mirror(s, outreq)
+
+    start := time.Now()
+    res, err := pool.transport.RoundTrip(outreq)
+    now := time.Now()
+    failed := err != nil || res.StatusCode >= 500
+    s.circuit.record(sprobe, failed, now.Sub(start), now)
+    node.circuit.record(l.probe, failed, now.Sub(start), now)
+    pool.traffic.observe(failed, now.Sub(start))
+    if reason == "split" {
+        pool.splitTraffic.observe(failed, now.Sub(start))
+    }
+
     if err != nil {
         log.Printf("proxy round trip error: %v", err)
         rw.WriteHeader(http.StatusInternalServerError)
         return
     }
+    defer res.Body.Close()
 
+    rewriteHeader(res.Header, resRules, vars)
     copyHeader(rw.Header(), res.Header)
 
     rw.WriteHeader(res.StatusCode)
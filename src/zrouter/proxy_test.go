@@ -0,0 +1,232 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+type validator interface {
+    Validate() error
+}
+
+// validated checks v as the admin API does before handing it to the proxy.
+func validated[T validator](t testing.TB, v T) T {
+    t.Helper()
+    if err := v.Validate(); err != nil {
+        t.Fatalf("Validate(%+v): %v", v, err)
+    }
+
+    return v
+}
+
+// newTestProxy returns a proxy with the service s of Url `/` and the nodes
+// given in its prod pool.
+func newTestProxy(t testing.TB, nodes ...*Node) *Proxy {
+    p := newProxy()
+    if err := p.PostService(&Service{Name: "s", Url: "/", DefaultPool: "prod"}); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, n := range nodes {
+        addNode(t, p, "prod", n)
+    }
+
+    return p
+}
+
+func backendHost(ts *httptest.Server) string {
+    return strings.TrimPrefix(ts.URL, "http://")
+}
+
+// startBackend serves h until the test ends and returns its host.
+func startBackend(t testing.TB, h http.Handler) string {
+    ts := httptest.NewServer(h)
+    t.Cleanup(ts.Close)
+    return backendHost(ts)
+}
+
+func addNode(t testing.TB, p *Proxy, pname string, n *Node) {
+    if err := p.PostServicePoolNode("s", pname, n); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Run with -race, admin calls change the services while requests go through.
+func TestProxyConcurrentAdmin(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer ts.Close()
+
+    p := newTestProxy(t, &Node{Name: "n1", Host: backendHost(ts), Status: "on"})
+
+    stop := make(chan struct{})
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for i := 0; ; i++ {
+            select {
+            case <-stop:
+                return
+            case <-time.After(100 * time.Microsecond):
+            }
+
+            p.PutServicePoolNode("s", "prod", &Node{Name: "n1", Status: "on", Weight: i % 10}, 0)
+            p.PostServicePoolNode("s", "prod", &Node{Name: "n2", Host: backendHost(ts), Status: "on", MaxConns: 1})
+            p.PutServiceSplit("s", &Split{Pool: "gray", Gray: float64(i % 100)})
+            p.PutServiceHeaders("s", &Headers{Request: []*HeaderRule{{Action: "set", Name: "X-I", Value: fmt.Sprint(i)}}})
+            p.ListServicePoolNode("s", "prod")
+            p.Metrics().WriteTo(ioutil.Discard)
+            p.DeleteServicePoolNode("s", "prod", "n2", 0)
+        }
+    }()
+
+    var failed int64
+    var clients sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        clients.Add(1)
+        go func() {
+            defer clients.Done()
+            for j := 0; j < 100; j++ {
+                rw := httptest.NewRecorder()
+                p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+                if rw.Code != http.StatusOK {
+                    atomic.AddInt64(&failed, 1)
+                }
+            }
+        }()
+    }
+
+    clients.Wait()
+    close(stop)
+    wg.Wait()
+
+    if failed > 0 {
+        t.Errorf("%d requests failed", failed)
+    }
+
+    node, _ := p.GetServicePoolNode("s", "prod", "n1")
+    if node.ConnNum != 0 {
+        t.Errorf("conns of n1 = %d after all requests, want 0", node.ConnNum)
+    }
+}
+
+func TestProxyMaxConns(t *testing.T) {
+    var conns, peak int64
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        n := atomic.AddInt64(&conns, 1)
+        for {
+            old := atomic.LoadInt64(&peak)
+            if n <= old || atomic.CompareAndSwapInt64(&peak, old, n) {
+                break
+            }
+        }
+        time.Sleep(5 * time.Millisecond)
+        atomic.AddInt64(&conns, -1)
+    }))
+    defer ts.Close()
+
+    p := newTestProxy(t, &Node{Name: "n1", Host: backendHost(ts), Status: "on", MaxConns: 2})
+    if err := p.PutServicePool("s", "prod", &Pool{LBPolicy: "random", MaxPending: 100, PendingTimeout: 5000}, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    var failed int64
+    var wg sync.WaitGroup
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            rw := httptest.NewRecorder()
+            p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+            if rw.Code != http.StatusOK {
+                atomic.AddInt64(&failed, 1)
+            }
+        }()
+    }
+    wg.Wait()
+
+    if failed > 0 {
+        t.Errorf("%d requests failed", failed)
+    }
+
+    if peak > 2 {
+        t.Errorf("peak conns = %d, want at most max_conns 2", peak)
+    }
+}
+
+func TestProxyUnloading(t *testing.T) {
+    started, finish := make(chan struct{}), make(chan struct{})
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        close(started)
+        <-finish
+    }))
+    defer ts.Close()
+
+    p := newTestProxy(t, &Node{Name: "n1", Host: backendHost(ts), Status: "on"})
+
+    done := make(chan struct{})
+    go func() {
+        p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+        close(done)
+    }()
+    <-started
+
+    p.PutServicePoolNode("s", "prod", &Node{Name: "n1", Status: "unloading"}, 0)
+    if node, _ := p.GetServicePoolNode("s", "prod", "n1"); node.Status != "unloading" {
+        t.Errorf("status with a request in flight = %s, want unloading", node.Status)
+    }
+
+    close(finish)
+    <-done
+
+    if node, _ := p.GetServicePoolNode("s", "prod", "n1"); node.Status != "off" {
+        t.Errorf("status after the last request = %s, want off", node.Status)
+    }
+}
+
+func benchmarkAcquire(b *testing.B, admin bool) {
+    nodes := make([]*Node, 0)
+    for i := 0; i < 10; i++ {
+        nodes = append(nodes, &Node{Name: fmt.Sprintf("n%d", i), Host: "127.0.0.1:1", Status: "on"})
+    }
+    p := newTestProxy(b, nodes...)
+
+    if admin {
+        stop := make(chan struct{})
+        defer close(stop)
+        go func() {
+            for i := 0; ; i++ {
+                select {
+                case <-stop:
+                    return
+                case <-time.After(time.Millisecond):
+                }
+                p.PutServicePoolNode("s", "prod", &Node{Name: "n0", Status: "on", Weight: i % 10}, 0)
+            }
+        }()
+    }
+
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        req := httptest.NewRequest("GET", "/", nil)
+        for pb.Next() {
+            s := p.lookup(req)
+            pool, _ := p.lookupPool(s, req)
+            l, err := p.acquire(pool, req)
+            if err != nil {
+                b.Fatal(err)
+            }
+            p.decreaseConn(pool, l.node)
+        }
+    })
+}
+
+func BenchmarkAcquireParallel(b *testing.B)          { benchmarkAcquire(b, false) }
+func BenchmarkAcquireParallelWithAdmin(b *testing.B) { benchmarkAcquire(b, true) }
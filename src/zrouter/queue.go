@@ -0,0 +1,216 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+var (
+    errNoNode = errors.New("no available node")
+    errBusy   = errors.New("all nodes are busy")
+)
+
+// poolQueue holds the requests waiting for a node of a pool, it is shared by
+// the copies of the pool.
+type poolQueue struct {
+    mu       sync.Mutex
+    waiters  []chan lease
+    pending  int64        // len(waiters), read without the lock
+    rejected int64        // requests rejected for a full queue or a queue timeout
+    pool     atomic.Value // *Pool, last published copy the nodes are taken from
+}
+
+// lease is a node taken for a request, probe tells whether the request is a
+// probe of the half-open breaker of the node, see circuit.allow.
+type lease struct {
+    node  *Node
+    probe bool
+}
+
+func newPoolQueue() *poolQueue {
+    return new(poolQueue)
+}
+
+func (p *Pool) serving() bool {
+    for _, node := range p.Nodes {
+        if node.Status == "on" {
+            return true
+        }
+    }
+
+    return false
+}
+
+// busy tells whether the pool has nodes on with their breakers letting
+// requests through, so that when take finds none of them available they are
+// all at their max_conns and requests should wait for a node rather than fail.
+func (p *Pool) busy() bool {
+    now := time.Now()
+    for _, node := range p.Nodes {
+        if node.Status == "on" && node.circuit.available(now) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (p *Pool) pendingTimeout() time.Duration {
+    if p.PendingTimeout <= 0 {
+        return time.Second
+    }
+
+    return time.Duration(p.PendingTimeout) * time.Millisecond
+}
+
+// take picks a node, passes its breaker and counts the request on it. Other
+// requests may take the last probe or the last connection of the node picked
+// meanwhile, so it picks again.
+func (p *Pool) take() lease {
+    for {
+        node := p.Pick()
+        if node == nil {
+            return lease{}
+        }
+
+        ok, probe := node.circuit.allow(time.Now())
+        if !ok {
+            continue
+        }
+
+        if node.take() {
+            return lease{node: node, probe: probe}
+        }
+
+        node.circuit.cancel(probe)
+    }
+}
+
+func (q *poolQueue) publish(pool *Pool) {
+    q.pool.Store(pool)
+
+    if atomic.LoadInt64(&q.pending) > 0 {
+        q.mu.Lock()
+        q.dispatch()
+        q.mu.Unlock()
+    }
+}
+
+// dispatch hands the available nodes to the waiting requests in FIFO order,
+// the connection is counted on the node before handing it over. The caller
+// holds the queue lock.
+func (q *poolQueue) dispatch() {
+    pool, _ := q.pool.Load().(*Pool)
+    if pool == nil {
+        return
+    }
+
+    for len(q.waiters) > 0 {
+        l := pool.take()
+        if l.node == nil {
+            return
+        }
+
+        q.waiters[0] <- l
+        q.waiters = q.waiters[1:]
+        atomic.StoreInt64(&q.pending, int64(len(q.waiters)))
+    }
+}
+
+func (q *poolQueue) dequeue(w chan lease) bool {
+    for i := range q.waiters {
+        if q.waiters[i] == w {
+            q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+            atomic.StoreInt64(&q.pending, int64(len(q.waiters)))
+            return true
+        }
+    }
+
+    return false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// acquire picks a node of the pool for the request and counts the connection
+// on it, the request waits in the pool queue if all nodes are busy. While
+// requests are waiting a new one queues behind them, so that it cannot take
+// a node released before the release hands it over.
+func (p *Proxy) acquire(pool *Pool, req *http.Request) (lease, error) {
+    if pool == nil {
+        return lease{}, errNoNode
+    }
+
+    q := pool.queue
+
+    if atomic.LoadInt64(&q.pending) == 0 {
+        if l := pool.take(); l.node != nil {
+            return l, nil
+        }
+    }
+
+    if !pool.serving() {
+        return lease{}, errNoNode
+    }
+
+    // breakers of all the serving nodes are open
+    if !pool.busy() {
+        atomic.AddInt64(&q.rejected, 1)
+        return lease{}, errBusy
+    }
+
+    q.mu.Lock()
+    if len(q.waiters) >= pool.MaxPending {
+        q.mu.Unlock()
+        atomic.AddInt64(&q.rejected, 1)
+        return lease{}, errBusy
+    }
+
+    // a node released since take is handed over by this dispatch, the later
+    // ones by the releases seeing the request pending
+    w := make(chan lease, 1)
+    q.waiters = append(q.waiters, w)
+    atomic.StoreInt64(&q.pending, int64(len(q.waiters)))
+    q.dispatch()
+    q.mu.Unlock()
+
+    timer := time.NewTimer(pool.pendingTimeout())
+    defer timer.Stop()
+
+    select {
+    case l := <-w:
+        return l, nil
+    case <-timer.C:
+    case <-req.Context().Done():
+    }
+
+    q.mu.Lock()
+    defer q.mu.Unlock()
+
+    if q.dequeue(w) {
+        atomic.AddInt64(&q.rejected, 1)
+        return lease{}, errBusy
+    }
+
+    // the node is handed over right before the timeout
+    return <-w, nil
+}
+
+// decreaseConn gives back the node taken by acquire and hands it to the next
+// waiting request.
+func (p *Proxy) decreaseConn(pool *Pool, node *Node) {
+    if node.release() {
+        p.Lock()
+        p.settle()
+        p.publish()
+        p.Unlock()
+    }
+
+    if q := pool.queue; atomic.LoadInt64(&q.pending) > 0 {
+        q.mu.Lock()
+        q.dispatch()
+        q.mu.Unlock()
+    }
+}
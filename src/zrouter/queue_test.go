@@ -0,0 +1,161 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// newQueueProxy returns a proxy with a single node n1 of max_conns 1 and the
+// queue given.
+func newQueueProxy(t *testing.T, maxPending, timeout int) *Proxy {
+    p := newTestProxy(t, &Node{Name: "n1", Host: "127.0.0.1:1", Status: "on", MaxConns: 1})
+    if err := p.PutServicePool("s", "prod", &Pool{LBPolicy: "random", MaxPending: maxPending, PendingTimeout: timeout}, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    return p
+}
+
+func queueAcquire(p *Proxy) (*Pool, *Node, error) {
+    req := httptest.NewRequest("GET", "/", nil)
+    pool, _ := p.lookupPool(p.lookup(req), req)
+    l, err := p.acquire(pool, req)
+    return pool, l.node, err
+}
+
+func TestQueueHandsOverReleasedNode(t *testing.T) {
+    p := newQueueProxy(t, 1, 5000)
+
+    pool, first, err := queueAcquire(p)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    type result struct {
+        node *Node
+        err  error
+    }
+    done := make(chan result)
+    go func() {
+        _, node, err := queueAcquire(p)
+        done <- result{node, err}
+    }()
+
+    for start := time.Now(); ; time.Sleep(time.Millisecond) {
+        if view, _ := p.GetServicePool("s", "prod"); view.Pending == 1 {
+            break
+        }
+
+        if time.Since(start) > time.Second {
+            t.Fatal("request not queued")
+        }
+    }
+
+    p.decreaseConn(pool, first)
+    r := <-done
+    if r.err != nil || r.node == nil || r.node.Name != "n1" {
+        t.Fatalf("queued request got %v, %v", r.node, r.err)
+    }
+
+    if n := r.node.connNum(); n != 1 {
+        t.Errorf("conns of n1 = %d, want 1 counted for the queued request", n)
+    }
+}
+
+func TestQueueFIFO(t *testing.T) {
+    p := newQueueProxy(t, 2, 5000)
+
+    pool, first, err := queueAcquire(p)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    queued := make(chan *Node)
+    go func() {
+        _, node, _ := queueAcquire(p)
+        queued <- node
+    }()
+
+    for start := time.Now(); atomic.LoadInt64(&pool.queue.pending) != 1; time.Sleep(time.Millisecond) {
+        if time.Since(start) > time.Second {
+            t.Fatal("request not queued")
+        }
+    }
+
+    // a newcomer arriving between the release and the hand over of
+    // decreaseConn must not overtake the queued request
+    first.release()
+    newcomer := make(chan *Node)
+    go func() {
+        _, node, _ := queueAcquire(p)
+        newcomer <- node
+    }()
+
+    select {
+    case node := <-queued:
+        if node == nil {
+            t.Fatal("queued request got no node")
+        }
+        p.decreaseConn(pool, node)
+    case node := <-newcomer:
+        t.Fatalf("newcomer took %v before the queued request", node)
+    }
+
+    if node := <-newcomer; node == nil {
+        t.Error("newcomer got no node after the queued request")
+    }
+}
+
+func TestQueueTimeout(t *testing.T) {
+    p := newQueueProxy(t, 1, 20)
+
+    pool, _, err := queueAcquire(p)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    start := time.Now()
+    if _, _, err := queueAcquire(p); err != errBusy {
+        t.Fatalf("acquire = %v, want errBusy", err)
+    }
+
+    if d := time.Since(start); d < 20*time.Millisecond {
+        t.Errorf("rejected after %v, want the pending timeout", d)
+    }
+
+    if n := atomic.LoadInt64(&pool.queue.rejected); n != 1 {
+        t.Errorf("rejected = %d, want 1", n)
+    }
+}
+
+func TestQueueFull(t *testing.T) {
+    p := newQueueProxy(t, 0, 5000)
+
+    if _, _, err := queueAcquire(p); err != nil {
+        t.Fatal(err)
+    }
+
+    // without room in the queue the request fails at once
+    start := time.Now()
+    rw := httptest.NewRecorder()
+    p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+    if rw.Code != http.StatusServiceUnavailable {
+        t.Errorf("code = %d, want 503", rw.Code)
+    }
+
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("rejected after %v, want at once", d)
+    }
+}
+
+func TestQueueNoNodeServing(t *testing.T) {
+    p := newQueueProxy(t, 10, 5000)
+    p.PutServicePoolNode("s", "prod", &Node{Name: "n1", Status: "off"}, 0)
+
+    if _, _, err := queueAcquire(p); err != errNoNode {
+        t.Errorf("acquire = %v, want errNoNode", err)
+    }
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    maxBuckets   = 65536
+    counterRetry = 5 * time.Second
+)
+
+// CounterStore keeps counters shared by all the zrouter replicas, so that a
+// rate limit holds for the whole cluster instead of each replica.
+type CounterStore interface {
+    // Incr increases the counter of key and returns the new value, the
+    // counter must live at least as long as window.
+    Incr(key string, window time.Duration) (int64, error)
+}
+
+// sharedCounters stops using the store for a while once it fails and the
+// local buckets take over, so an unreachable store costs one timeout at most.
+type sharedCounters struct {
+    CounterStore
+    mu   sync.Mutex
+    down time.Time
+}
+
+type RateLimit struct {
+    Name   string  `json:"name"`
+    Key    string  `json:"key"`    // `ip/header/path`, what requests are counted by
+    Header string  `json:"header"` // header carrying the key if Key is `header`, e.g. `X-Api-Key`
+    Prefix string  `json:"prefix"` // only limit requests under the path prefix, all requests of the service if empty
+    Rate   float64 `json:"rate"`   // requests per second
+    Burst  int     `json:"burst"`  // max requests at once, defaults to Rate
+    local  *buckets
+}
+
+// buckets are the local token buckets of a rate limit by key, kept apart from
+// the RateLimit so that a hot update carries them over.
+type buckets struct {
+    mu sync.Mutex
+    m  map[string]*bucket
+}
+
+type bucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// limitHit is a rate limit matching the request and the key it counts by.
+type limitHit struct {
+    r   *RateLimit
+    key string
+}
+
+type quota struct {
+    limit     int
+    remaining int
+    reset     time.Duration // until the bucket is full again
+    wait      time.Duration // until the next request is allowed, 0 if allowed
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func (r *RateLimit) Validate() error {
+    switch r.Key {
+    case "ip", "path":
+    case "header":
+        if len(r.Header) == 0 {
+            return fmt.Errorf("empty header of rate limit %s", r.Name)
+        }
+    default:
+        return fmt.Errorf("invalid key %q of rate limit %s", r.Key, r.Name)
+    }
+
+    if r.Rate <= 0 {
+        return fmt.Errorf("invalid rate of rate limit %s", r.Name)
+    }
+
+    if r.Burst <= 0 {
+        r.Burst = int(math.Ceil(r.Rate))
+    }
+
+    r.local = &buckets{m: make(map[string]*bucket)}
+    return nil
+}
+
+// inherit takes over the buckets of the rate limit replaced by r, as long as
+// it counts the same keys, so that the clients do not get a full burst again.
+func (r *RateLimit) inherit(old *RateLimit) {
+    if old.Key == r.Key && old.Header == r.Header && old.Prefix == r.Prefix {
+        r.local = old.local
+    }
+}
+
+// match returns the bucket key the request is counted by, or false if the
+// rate limit does not apply to the request.
+func (r *RateLimit) match(s *Service, req *http.Request) (string, bool) {
+    prefix := r.Prefix
+    if len(prefix) == 0 {
+        prefix = s.Url
+    }
+
+    if !strings.HasPrefix(req.URL.Path, prefix) {
+        return "", false
+    }
+
+    switch r.Key {
+    case "ip":
+        if ip := clientIP(req); ip != nil {
+            return ip.String(), true
+        }
+        return req.RemoteAddr, true
+    case "header":
+        if key := req.Header.Get(r.Header); len(key) > 0 {
+            return key, true
+        }
+
+        // without the header the client is counted by its IP, apart from
+        // the header values
+        if ip := clientIP(req); ip != nil {
+            return "ip:" + ip.String(), true
+        }
+        return "ip:" + req.RemoteAddr, true
+    case "path":
+        return prefix, true
+    }
+
+    return "", false
+}
+
+// take refills the bucket of key and takes a token from it if consume, the
+// quota tells whether the request is allowed either way.
+func (r *RateLimit) take(key string, now time.Time, consume bool) quota {
+    r.local.mu.Lock()
+    defer r.local.mu.Unlock()
+
+    b, ok := r.local.m[key]
+    if !ok {
+        if len(r.local.m) >= maxBuckets {
+            r.sweep(now)
+        }
+
+        b = &bucket{tokens: float64(r.Burst), last: now}
+        r.local.m[key] = b
+    }
+
+    burst := float64(r.Burst)
+    b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*r.Rate)
+    b.last = now
+
+    q := quota{limit: r.Burst}
+    if b.tokens >= 1 {
+        if consume {
+            b.tokens--
+        }
+    } else {
+        q.wait = r.duration(1 - b.tokens)
+    }
+
+    q.remaining = int(b.tokens)
+    q.reset = r.duration(burst - b.tokens)
+    return q
+}
+
+// takeShared counts the request in the store with fixed windows, each
+// window lasts as long as refilling the whole bucket and allows Burst requests.
+func (r *RateLimit) takeShared(store CounterStore, key string, now time.Time) (quota, error) {
+    window := r.duration(float64(r.Burst))
+    if window <= 0 {
+        window = time.Millisecond
+    }
+
+    i := now.UnixNano() / int64(window)
+    n, err := store.Incr(fmt.Sprintf("zrouter:ratelimit:%s:%d", key, i), window)
+    if err != nil {
+        return quota{}, err
+    }
+
+    q := quota{limit: r.Burst, reset: time.Unix(0, (i+1)*int64(window)).Sub(now)}
+    if n <= int64(r.Burst) {
+        q.remaining = r.Burst - int(n)
+    } else {
+        q.wait = q.reset
+    }
+
+    return q, nil
+}
+
+func (r *RateLimit) duration(tokens float64) time.Duration {
+    return time.Duration(tokens / r.Rate * float64(time.Second))
+}
+
+// sweep drops the buckets which are full by now, they are the same as new ones.
+func (r *RateLimit) sweep(now time.Time) {
+    for key, b := range r.local.m {
+        if b.tokens+now.Sub(b.last).Seconds()*r.Rate >= float64(r.Burst) {
+            delete(r.local.m, key)
+        }
+    }
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func newSharedCounters(store CounterStore) *sharedCounters {
+    return &sharedCounters{CounterStore: store}
+}
+
+func (c *sharedCounters) up(now time.Time) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    return !now.Before(c.down)
+}
+
+func (c *sharedCounters) fail(now time.Time) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.down = now.Add(counterRetry)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func ceilSeconds(d time.Duration) string {
+    return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// tighter returns the quota of q and t which is closer to rejection.
+func tighter(t *quota, q quota) *quota {
+    if t == nil || q.wait > t.wait || (q.wait == t.wait && q.remaining < t.remaining) {
+        return &q
+    }
+
+    return t
+}
+
+// takeLocal checks all the limits before taking from any of them, so that a
+// request rejected by one costs nothing of the others.
+func takeLocal(hits []limitHit, now time.Time) *quota {
+    var tightest *quota
+    for _, h := range hits {
+        if q := h.r.take(h.key, now, false); q.wait > 0 {
+            tightest = tighter(tightest, q)
+        }
+    }
+
+    if tightest != nil {
+        return tightest
+    }
+
+    for _, h := range hits {
+        tightest = tighter(tightest, h.r.take(h.key, now, true))
+    }
+
+    return tightest
+}
+
+// takeShared counts the request in the shared store limit by limit. The store
+// cannot tell without counting, so it stops at the first limit exceeded and
+// the later ones are not counted. It returns false if the store is not used.
+func (p *Proxy) takeShared(s *Service, hits []limitHit, now time.Time) (*quota, bool) {
+    c := p.counters
+    if c == nil || !c.up(now) {
+        return nil, false
+    }
+
+    var tightest *quota
+    for _, h := range hits {
+        q, err := h.r.takeShared(c, s.Name+":"+h.r.Name+":"+h.key, now)
+        if err != nil {
+            log.Printf("rate limit counter store error, fall back to local limits: %v", err)
+            c.fail(now)
+            return nil, false
+        }
+
+        if tightest = tighter(tightest, q); q.wait > 0 {
+            break
+        }
+    }
+
+    return tightest, true
+}
+
+// limit applies the rate limits of the service to the request, it writes a
+// 429 response and returns false if any of them is exceeded.
+func (p *Proxy) limit(s *Service, rw http.ResponseWriter, req *http.Request) bool {
+    if len(s.RateLimits) == 0 {
+        return true
+    }
+
+    hits := make([]limitHit, 0, len(s.RateLimits))
+    for _, r := range s.RateLimits {
+        if key, ok := r.match(s, req); ok {
+            hits = append(hits, limitHit{r: r, key: key})
+        }
+    }
+
+    if len(hits) == 0 {
+        return true
+    }
+
+    now := time.Now()
+    tightest, ok := p.takeShared(s, hits, now)
+    if !ok {
+        tightest = takeLocal(hits, now)
+    }
+
+    rw.Header().Set("X-RateLimit-Limit", strconv.Itoa(tightest.limit))
+    rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(tightest.remaining))
+    rw.Header().Set("X-RateLimit-Reset", ceilSeconds(tightest.reset))
+
+    if tightest.wait > 0 {
+        rw.Header().Set("Retry-After", ceilSeconds(tightest.wait))
+        rw.WriteHeader(http.StatusTooManyRequests)
+        return false
+    }
+
+    return true
+}
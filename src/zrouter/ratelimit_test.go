@@ -0,0 +1,123 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func limitRequest(p *Proxy, remote, apiKey string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest("GET", "/", nil)
+    req.RemoteAddr = remote
+    if len(apiKey) > 0 {
+        req.Header.Set("X-Api-Key", apiKey)
+    }
+
+    rw := httptest.NewRecorder()
+    if p.limit(p.Services[0], rw, req) {
+        rw.Code = http.StatusOK
+    }
+
+    return rw
+}
+
+func TestRateLimitRefill(t *testing.T) {
+    r := validated(t, &RateLimit{Name: "r", Key: "path", Rate: 10, Burst: 2})
+
+    now := time.Now()
+    for i, want := range []bool{true, true, false} {
+        if q := r.take("k", now, true); (q.wait == 0) != want {
+            t.Errorf("request %d allowed = %v, want %v", i, q.wait == 0, want)
+        }
+    }
+
+    if q := r.take("k", now.Add(50*time.Millisecond), true); q.wait == 0 {
+        t.Error("request allowed before a token is refilled")
+    }
+
+    if q := r.take("k", now.Add(150*time.Millisecond), true); q.wait != 0 {
+        t.Errorf("request rejected after a token is refilled, wait %v", q.wait)
+    }
+
+    // refilling stops at the burst
+    if q := r.take("k", now.Add(time.Hour), true); q.remaining != 1 {
+        t.Errorf("remaining after an hour = %d, want 1", q.remaining)
+    }
+}
+
+func TestRateLimitResponse(t *testing.T) {
+    p := newTestProxy(t)
+    p.PostServiceRateLimit("s", validated(t, &RateLimit{Name: "r", Key: "ip", Rate: 0.5, Burst: 2}))
+
+    rw := limitRequest(p, "192.0.2.1:1000", "")
+    if rw.Code != http.StatusOK || rw.Header().Get("X-RateLimit-Limit") != "2" || rw.Header().Get("X-RateLimit-Remaining") != "1" || rw.Header().Get("X-RateLimit-Reset") != "2" {
+        t.Errorf("first request: %d %v", rw.Code, rw.Header())
+    }
+
+    limitRequest(p, "192.0.2.1:1000", "")
+    rw = limitRequest(p, "192.0.2.1:1000", "")
+    if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != "2" || rw.Header().Get("X-RateLimit-Remaining") != "0" {
+        t.Errorf("third request: %d %v", rw.Code, rw.Header())
+    }
+
+    // other clients have their own buckets
+    if rw = limitRequest(p, "192.0.2.2:1000", ""); rw.Code != http.StatusOK {
+        t.Errorf("request of another client: %d", rw.Code)
+    }
+}
+
+func TestRateLimitRejectedCostsNothing(t *testing.T) {
+    p := newTestProxy(t)
+    service := validated(t, &RateLimit{Name: "service", Key: "path", Rate: 1, Burst: 3})
+    p.PostServiceRateLimit("s", service)
+    p.PostServiceRateLimit("s", validated(t, &RateLimit{Name: "client", Key: "ip", Rate: 1, Burst: 1}))
+
+    limitRequest(p, "192.0.2.1:1000", "")
+    for i := 0; i < 5; i++ {
+        if rw := limitRequest(p, "192.0.2.1:1000", ""); rw.Code != http.StatusTooManyRequests {
+            t.Fatalf("request %d of the client: %d", i, rw.Code)
+        }
+    }
+
+    if q := service.take("/", time.Now(), false); q.remaining != 2 {
+        t.Errorf("remaining of the service limit = %d, want 2", q.remaining)
+    }
+}
+
+func TestRateLimitHotUpdate(t *testing.T) {
+    p := newTestProxy(t)
+    p.PostServiceRateLimit("s", validated(t, &RateLimit{Name: "r", Key: "ip", Rate: 0.1, Burst: 1}))
+
+    limitRequest(p, "192.0.2.1:1000", "")
+    p.PutServiceRateLimit("s", validated(t, &RateLimit{Name: "r", Key: "ip", Rate: 0.2, Burst: 1}))
+    if rw := limitRequest(p, "192.0.2.1:1000", ""); rw.Code != http.StatusTooManyRequests {
+        t.Errorf("request after the update: %d, want the bucket kept", rw.Code)
+    }
+
+    // counting by another key starts over
+    p.PutServiceRateLimit("s", validated(t, &RateLimit{Name: "r", Key: "header", Header: "X-Api-Key", Rate: 0.2, Burst: 1}))
+    if rw := limitRequest(p, "192.0.2.1:1000", "k1"); rw.Code != http.StatusOK {
+        t.Errorf("request after the key changed: %d", rw.Code)
+    }
+}
+
+func TestRateLimitMissingHeader(t *testing.T) {
+    p := newTestProxy(t)
+    p.PostServiceRateLimit("s", validated(t, &RateLimit{Name: "r", Key: "header", Header: "X-Api-Key", Rate: 0.1, Burst: 1}))
+
+    for _, c := range []struct {
+        remote, key string
+        code        int
+    }{
+        {"192.0.2.1:1000", "", http.StatusOK},
+        {"192.0.2.2:1000", "", http.StatusOK},
+        {"192.0.2.1:1000", "", http.StatusTooManyRequests},
+        {"192.0.2.1:1000", "k1", http.StatusOK},
+        {"192.0.2.3:1000", "k1", http.StatusTooManyRequests},
+    } {
+        if rw := limitRequest(p, c.remote, c.key); rw.Code != c.code {
+            t.Errorf("request from %s with key %q: %d, want %d", c.remote, c.key, rw.Code, c.code)
+        }
+    }
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "net"
+    "strconv"
+    "time"
+)
+
+// redisStore is a CounterStore speaking the redis protocol, counters are
+// kept with INCR and expired with PEXPIRE.
+type redisStore struct {
+    addr    string
+    timeout time.Duration
+    idle    chan *redisConn
+}
+
+type redisConn struct {
+    net.Conn
+    r *bufio.Reader
+}
+
+func newRedisStore(addr string, timeout time.Duration) *redisStore {
+    return &redisStore{
+        addr:    addr,
+        timeout: timeout,
+        idle:    make(chan *redisConn, 16),
+    }
+}
+
+func (s *redisStore) get() (*redisConn, error) {
+    select {
+    case c := <-s.idle:
+        return c, nil
+    default:
+    }
+
+    conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+    if err != nil {
+        return nil, err
+    }
+
+    return &redisConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (s *redisStore) put(c *redisConn) {
+    select {
+    case s.idle <- c:
+    default:
+        c.Close()
+    }
+}
+
+func (s *redisStore) Incr(key string, window time.Duration) (int64, error) {
+    c, err := s.get()
+    if err != nil {
+        return 0, err
+    }
+
+    c.SetDeadline(time.Now().Add(s.timeout))
+
+    // both commands go in one round trip, the expiry only has to outlive the window
+    ttl := strconv.FormatInt(int64(window/time.Millisecond)+1, 10)
+    buf := appendCommand(nil, "INCR", key)
+    buf = appendCommand(buf, "PEXPIRE", key, ttl)
+    if _, err := c.Write(buf); err != nil {
+        c.Close()
+        return 0, err
+    }
+
+    n, err := c.readInt()
+    if err == nil {
+        _, err = c.readInt()
+    }
+
+    if err != nil {
+        c.Close()
+        return 0, err
+    }
+
+    s.put(c)
+    return n, nil
+}
+
+func appendCommand(buf []byte, args ...string) []byte {
+    buf = append(buf, fmt.Sprintf("*%d\r\n", len(args))...)
+    for _, arg := range args {
+        buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+    }
+
+    return buf
+}
+
+func (c *redisConn) readLine() (string, error) {
+    line, err := c.r.ReadString('\n')
+    if err != nil {
+        return "", err
+    }
+
+    if len(line) < 3 || line[len(line)-2] != '\r' {
+        return "", errors.New("redis: malformed reply")
+    }
+
+    return line[:len(line)-2], nil
+}
+
+func (c *redisConn) readInt() (int64, error) {
+    line, err := c.readLine()
+    if err != nil {
+        return 0, err
+    }
+
+    switch line[0] {
+    case ':':
+        return strconv.ParseInt(line[1:], 10, 64)
+    case '-':
+        return 0, fmt.Errorf("redis: %s", line[1:])
+    }
+
+    return 0, fmt.Errorf("redis: unexpected reply %q", line)
+}
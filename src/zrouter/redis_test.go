@@ -0,0 +1,184 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeRedis is an in-process server answering the redis commands used by
+// redisStore.
+type fakeRedis struct {
+    sync.Mutex
+    net.Listener
+    counters map[string]int64
+    ttls     map[string]int64
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    f := &fakeRedis{Listener: l, counters: make(map[string]int64), ttls: make(map[string]int64)}
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go f.serve(conn)
+        }
+    }()
+
+    return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+    defer conn.Close()
+
+    r := bufio.NewReader(conn)
+    for {
+        args, err := readCommand(r)
+        if err != nil {
+            return
+        }
+
+        f.Lock()
+        var reply string
+        switch args[0] {
+        case "INCR":
+            f.counters[args[1]]++
+            reply = fmt.Sprintf(":%d\r\n", f.counters[args[1]])
+        case "PEXPIRE":
+            ttl, _ := strconv.ParseInt(args[2], 10, 64)
+            f.ttls[args[1]] = ttl
+            reply = ":1\r\n"
+        default:
+            reply = "-ERR unknown command\r\n"
+        }
+        f.Unlock()
+
+        conn.Write([]byte(reply))
+    }
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+    var n int
+    if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+        return nil, err
+    }
+
+    args := make([]string, n)
+    for i := range args {
+        var size int
+        if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+            return nil, err
+        }
+
+        buf := make([]byte, size+2)
+        if _, err := io.ReadFull(r, buf); err != nil {
+            return nil, err
+        }
+        args[i] = string(buf[:size])
+    }
+
+    return args, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestRedisStoreIncr(t *testing.T) {
+    f := newFakeRedis(t)
+    defer f.Close()
+
+    store := newRedisStore(f.Addr().String(), time.Second)
+    for i := int64(1); i <= 3; i++ {
+        n, err := store.Incr("k", 1500*time.Millisecond)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if n != i {
+            t.Errorf("Incr = %d, want %d", n, i)
+        }
+    }
+
+    f.Lock()
+    defer f.Unlock()
+
+    if ttl := f.ttls["k"]; ttl < 1500 {
+        t.Errorf("ttl = %d, want at least the window", ttl)
+    }
+}
+
+func TestSharedRateLimitAcrossReplicas(t *testing.T) {
+    f := newFakeRedis(t)
+    defer f.Close()
+
+    s := &Service{Name: "s", Url: "/"}
+    r := &RateLimit{Name: "r", Key: "path", Rate: 1, Burst: 2}
+    validated(t, r)
+    s.RateLimits = []*RateLimit{r}
+
+    // two replicas with their own local buckets sharing one store
+    replicas := []*Proxy{new(Proxy), new(Proxy)}
+    for _, p := range replicas {
+        p.counters = newSharedCounters(newRedisStore(f.Addr().String(), time.Second))
+    }
+
+    // keep clear of a window boundary
+    if time.Now().UnixNano()%int64(2*time.Second) > int64(1500*time.Millisecond) {
+        time.Sleep(600 * time.Millisecond)
+    }
+
+    codes := make([]int, 0)
+    for _, p := range append(replicas, replicas...) {
+        w := httptest.NewRecorder()
+        if p.limit(s, w, httptest.NewRequest("GET", "/", nil)) {
+            codes = append(codes, http.StatusOK)
+        } else {
+            codes = append(codes, w.Code)
+        }
+    }
+
+    want := []int{200, 200, 429, 429}
+    for i := range want {
+        if codes[i] != want[i] {
+            t.Fatalf("codes = %v, want %v", codes, want)
+        }
+    }
+}
+
+func TestSharedRateLimitFallback(t *testing.T) {
+    f := newFakeRedis(t)
+    addr := f.Addr().String()
+    f.Close()
+
+    s := &Service{Name: "s", Url: "/"}
+    r := &RateLimit{Name: "r", Key: "ip", Rate: 1, Burst: 1}
+    validated(t, r)
+    s.RateLimits = []*RateLimit{r}
+
+    p := new(Proxy)
+    p.counters = newSharedCounters(newRedisStore(addr, 100*time.Millisecond))
+
+    for i, want := range []bool{true, false} {
+        w := httptest.NewRecorder()
+        if got := p.limit(s, w, httptest.NewRequest("GET", "/", nil)); got != want {
+            t.Errorf("request %d allowed = %v, want %v", i, got, want)
+        }
+    }
+
+    if p.counters.up(time.Now()) {
+        t.Errorf("store is still used after failure")
+    }
+}
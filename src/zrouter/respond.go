@@ -0,0 +1,71 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+)
+
+type Redirect struct {
+    Status int    `json:"status"` // `301/302/303/307/308`, 0 means 302
+    Target string `json:"target"` // location, may refer to ${host}, ${path}, ${query}, ${uri} and ${client_ip}
+}
+
+type StaticResponse struct {
+    Status  int               `json:"status"` // `200 ~ 599`, 0 means 200
+    Headers map[string]string `json:"headers"`
+    Body    string            `json:"body"`
+}
+
+func (r *Redirect) Validate() error {
+    if r.Status == 0 {
+        r.Status = http.StatusFound
+    }
+
+    switch r.Status {
+    case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+    default:
+        return fmt.Errorf("invalid redirect status %d", r.Status)
+    }
+
+    if len(r.Target) == 0 {
+        return fmt.Errorf("empty redirect target")
+    }
+
+    return nil
+}
+
+func (r *StaticResponse) Validate() error {
+    if r.Status == 0 {
+        r.Status = http.StatusOK
+    }
+
+    // 1xx are not final responses and carry no body
+    if r.Status < 200 || r.Status > 599 {
+        return fmt.Errorf("invalid response status %d", r.Status)
+    }
+
+    return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// respond answers the request of a redirect or static response service by
+// itself, it returns false if the service proxies to its nodes.
+func (p *Proxy) respond(s *Service, rw http.ResponseWriter, req *http.Request) bool {
+    switch {
+    case s.Redirect != nil:
+        vars := &headerVars{req: req, service: s.Name}
+        http.Redirect(rw, req, vars.expand(s.Redirect.Target), s.Redirect.Status)
+    case s.Response != nil:
+        for k, v := range s.Response.Headers {
+            rw.Header().Set(k, v)
+        }
+        rw.WriteHeader(s.Response.Status)
+        io.WriteString(rw, s.Response.Body)
+    default:
+        return false
+    }
+
+    return true
+}
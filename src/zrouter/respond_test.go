@@ -0,0 +1,84 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestRedirect(t *testing.T) {
+    p := newTestProxy(t)
+
+    for _, c := range []struct {
+        redirect *Redirect
+        url      string
+        code     int
+        location string
+    }{
+        {&Redirect{Target: "https://${host}${uri}"}, "http://example.com/a?x=1", http.StatusFound, "https://example.com/a?x=1"},
+        {&Redirect{Status: 301, Target: "https://new.example.com${path}"}, "http://example.com/a?x=1", http.StatusMovedPermanently, "https://new.example.com/a"},
+        {&Redirect{Status: 308, Target: "/login?next=${path}&${query}"}, "http://example.com/a?x=1", http.StatusPermanentRedirect, "/login?next=/a&x=1"},
+        {&Redirect{Status: 303, Target: "/done"}, "http://example.com/a", http.StatusSeeOther, "/done"},
+    } {
+        validated(t, c.redirect)
+        p.PutService(&Service{Name: "s", Url: "/", Redirect: c.redirect}, 0)
+
+        rw := httptest.NewRecorder()
+        p.ServeHTTP(rw, httptest.NewRequest("GET", c.url, nil))
+        if rw.Code != c.code || rw.Header().Get("Location") != c.location {
+            t.Errorf("redirect %s of %s: %d %s, want %d %s", c.redirect.Target, c.url, rw.Code, rw.Header().Get("Location"), c.code, c.location)
+        }
+    }
+}
+
+func TestStaticResponse(t *testing.T) {
+    p := newTestProxy(t)
+
+    r := &StaticResponse{Headers: map[string]string{"Content-Type": "application/json"}, Body: `{"ok":true}`}
+    validated(t, r)
+    p.PutService(&Service{Name: "s", Url: "/", Response: r}, 0)
+
+    rw := httptest.NewRecorder()
+    p.ServeHTTP(rw, httptest.NewRequest("GET", "/anything", nil))
+    if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "application/json" || rw.Body.String() != `{"ok":true}` {
+        t.Errorf("response: %d %v %s", rw.Code, rw.Header(), rw.Body)
+    }
+
+    r = &StaticResponse{Status: 410, Body: "gone"}
+    r.Validate()
+    p.PutService(&Service{Name: "s", Url: "/", Response: r}, 0)
+
+    rw = httptest.NewRecorder()
+    p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+    if rw.Code != http.StatusGone || rw.Body.String() != "gone" {
+        t.Errorf("response: %d %s", rw.Code, rw.Body)
+    }
+}
+
+func TestRespondValidate(t *testing.T) {
+    for _, status := range []int{100, 199, 600, 999} {
+        if err := (&StaticResponse{Status: status}).Validate(); err == nil {
+            t.Errorf("static response of status %d accepted", status)
+        }
+    }
+
+    for _, status := range []int{200, 204, 404, 599} {
+        if err := (&StaticResponse{Status: status}).Validate(); err != nil {
+            t.Errorf("static response of status %d: %v", status, err)
+        }
+    }
+
+    for _, status := range []int{200, 300, 304, 305} {
+        if err := (&Redirect{Status: status, Target: "/"}).Validate(); err == nil {
+            t.Errorf("redirect of status %d accepted", status)
+        }
+    }
+
+    if err := (&Redirect{}).Validate(); err == nil {
+        t.Error("redirect without target accepted")
+    }
+
+    if err := (&Service{Name: "s", Redirect: &Redirect{Target: "/"}, Response: &StaticResponse{}}).Validate(); err == nil {
+        t.Error("service with redirect and response accepted")
+    }
+}
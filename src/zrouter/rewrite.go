@@ -0,0 +1,102 @@
+package main
+
+import (
+    "fmt"
+    "net/url"
+    "regexp"
+    "strings"
+)
+
+type Rewrite struct {
+    StripPrefix   bool   `json:"strip_prefix"`   // removes the Url of the service from the path
+    ReplacePrefix string `json:"replace_prefix"` // puts this prefix in place of the Url of the service
+    Regex         string `json:"regex"`          // rewrites the path matching it, after the prefix
+    Replacement   string `json:"replacement"`    // path the regex rewrites to, may refer to capture groups as $1 or ${name}
+    HostHeader    string `json:"host_header"`    // `client` keeps the host of the client, `node` uses Node.Host, others are sent as is
+    re            *regexp.Regexp
+}
+
+func (r *Rewrite) Validate() error {
+    if r.StripPrefix && len(r.ReplacePrefix) > 0 {
+        return fmt.Errorf("strip_prefix and replace_prefix are exclusive")
+    }
+
+    if len(r.ReplacePrefix) > 0 && !strings.HasPrefix(r.ReplacePrefix, "/") {
+        return fmt.Errorf("replace_prefix must start with /")
+    }
+
+    if len(r.Regex) > 0 {
+        re, err := regexp.Compile(r.Regex)
+        if err != nil {
+            return fmt.Errorf("invalid regex of rewrite: %v", err)
+        }
+        r.re = re
+    }
+
+    if len(r.HostHeader) == 0 {
+        r.HostHeader = "client"
+    }
+
+    return nil
+}
+
+// apply rewrites the path of u, prefix is the Url of the service the request
+// matched. The escaped path is rewritten, so that encoded characters like
+// `%2F` reach the upstream as the client sent them.
+func (r *Rewrite) apply(u *url.URL, prefix string) {
+    escaped := u.EscapedPath()
+    path := escaped
+    prefix = (&url.URL{Path: prefix}).EscapedPath()
+
+    if (r.StripPrefix || len(r.ReplacePrefix) > 0) && strings.HasPrefix(path, prefix) {
+        rest := strings.TrimPrefix(path, prefix)
+        head := r.ReplacePrefix
+        if len(head) == 0 {
+            head = "/"
+        }
+
+        switch {
+        case strings.HasSuffix(head, "/") && strings.HasPrefix(rest, "/"):
+            path = head + rest[1:]
+        case strings.HasSuffix(head, "/") || strings.HasPrefix(rest, "/") || len(rest) == 0:
+            path = head + rest
+        default:
+            path = head + "/" + rest
+        }
+    }
+
+    if r.re != nil {
+        path = r.re.ReplaceAllString(path, r.Replacement)
+    }
+
+    if !strings.HasPrefix(path, "/") {
+        path = "/" + path
+    }
+
+    if path == escaped {
+        return
+    }
+
+    unescaped, err := url.PathUnescape(path)
+    if err != nil {
+        // the replacement made an invalid escape, send it as a plain path
+        u.Path = path
+        u.RawPath = ""
+        return
+    }
+
+    u.Path = unescaped
+    u.RawPath = path
+}
+
+// host returns the Host header sent upstream.
+func (r *Rewrite) host(client string, node *Node) string {
+    switch r.HostHeader {
+    case "client":
+        return client
+    case "node":
+        return node.Host
+    }
+
+    return r.HostHeader
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "testing"
+)
+
+func TestRewriteApply(t *testing.T) {
+    for _, c := range []struct {
+        rewrite      *Rewrite
+        prefix, path string
+        want         string
+    }{
+        {&Rewrite{StripPrefix: true}, "/api/", "/api/users", "/users"},
+        {&Rewrite{StripPrefix: true}, "/api", "/api/users", "/users"},
+        {&Rewrite{StripPrefix: true}, "/api", "/api", "/"},
+        {&Rewrite{StripPrefix: true}, "/api/", "/api/", "/"},
+        {&Rewrite{StripPrefix: true}, "/api/", "/other/x", "/other/x"},
+        {&Rewrite{ReplacePrefix: "/v2/"}, "/api/", "/api/users", "/v2/users"},
+        {&Rewrite{ReplacePrefix: "/v2"}, "/api/", "/api/users", "/v2/users"},
+        {&Rewrite{ReplacePrefix: "/v2/"}, "/api", "/api/users", "/v2/users"},
+        {&Rewrite{ReplacePrefix: "/v2"}, "/api", "/api/users", "/v2/users"},
+        {&Rewrite{ReplacePrefix: "/v2"}, "/api", "/api", "/v2"},
+        {&Rewrite{Regex: `^/users/(\d+)$`, Replacement: "/u/$1"}, "/", "/users/42", "/u/42"},
+        {&Rewrite{Regex: `^/(?P<kind>\w+)/(?P<id>\d+)$`, Replacement: "/${id}/${kind}"}, "/", "/users/42", "/42/users"},
+        {&Rewrite{Regex: `^/users/(\d+)$`, Replacement: "/u/$1"}, "/", "/items/42", "/items/42"},
+        {&Rewrite{StripPrefix: true, Regex: `^/(\d+)$`, Replacement: "id/$1"}, "/api/", "/api/42", "/id/42"},
+        {&Rewrite{StripPrefix: true}, "/legacy/", "/legacy/a%2Fb", "/a%2Fb"},
+        {&Rewrite{ReplacePrefix: "/v2"}, "/legacy", "/legacy/a%2Fb", "/v2/a%2Fb"},
+        {&Rewrite{Regex: `^/files/(.+)$`, Replacement: "/f/$1"}, "/", "/files/a%2Fb%20c", "/f/a%2Fb%20c"},
+        {&Rewrite{StripPrefix: true}, "/a b/", "/a%20b/x", "/x"},
+    } {
+        u, err := url.Parse(c.path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        validated(t, c.rewrite).apply(u, c.prefix)
+        if u.EscapedPath() != c.want {
+            t.Errorf("%+v of %s under %s = %s, want %s", c.rewrite, c.path, c.prefix, u.EscapedPath(), c.want)
+        }
+    }
+}
+
+func TestRewriteHost(t *testing.T) {
+    var host string
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { host = r.Host }))
+    defer ts.Close()
+
+    p := newTestProxy(t, &Node{Name: "n1", Host: backendHost(ts), Status: "on"})
+    for _, c := range []struct {
+        mode, want string
+    }{
+        {"", "example.com"},
+        {"client", "example.com"},
+        {"node", backendHost(ts)},
+        {"api.internal", "api.internal"},
+    } {
+        p.PutService(&Service{Name: "s", Url: "/", Rewrite: validated(t, &Rewrite{HostHeader: c.mode})}, 0)
+        p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil))
+        if host != c.want {
+            t.Errorf("host of %q = %s, want %s", c.mode, host, c.want)
+        }
+    }
+}
+
+func TestRewriteValidate(t *testing.T) {
+    for _, r := range []*Rewrite{
+        {StripPrefix: true, ReplacePrefix: "/v2"},
+        {ReplacePrefix: "v2"},
+        {Regex: "("},
+    } {
+        if err := r.Validate(); err == nil {
+            t.Errorf("Validate(%+v) succeeded, want error", r)
+        }
+    }
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "time"
+)
+
+const (
+    maxRollouts      = 10
+    maxRolloutRounds = 10 // intervals a step waits for enough gray traffic
+)
+
+type Rollout struct {
+    Pool         string    `json:"pool"`           // canary pool promoted into the default pool at last, `gray` by default
+    Steps        []float64 `json:"steps"`          // gray percentages stepped through, defaults to 1, 5, 25, 50, 100
+    Interval     int       `json:"interval"`       // seconds each step lasts, 0 means 60
+    MinRequests  int       `json:"min_requests"`   // gray requests a step needs to be judged, 0 means 20
+    MaxErrorRate float64   `json:"max_error_rate"` // allowed excess of the gray error rate over prod, 0 means 0.01
+    MaxLatency   float64   `json:"max_latency"`    // allowed ratio of the gray mean latency to prod, 0 means 1.5
+    Sticky       string    `json:"sticky"`         // sticky key of the split, see Split
+}
+
+type RolloutStep struct {
+    Gray          float64   `json:"gray"`
+    Started       time.Time `json:"started"`
+    Finished      time.Time `json:"finished"`
+    GrayRequests  int64     `json:"gray_requests"`
+    GrayErrorRate float64   `json:"gray_error_rate"`
+    GrayLatency   float64   `json:"gray_latency"`   // mean milliseconds to response headers
+    ProdRequests  int64     `json:"prod_requests"`
+    ProdErrorRate float64   `json:"prod_error_rate"`
+    ProdLatency   float64   `json:"prod_latency"`
+    Result        string    `json:"result"`         // `running/passed/failed/aborted`
+}
+
+type RolloutStatus struct {
+    Rollout  *Rollout       `json:"rollout"`
+    State    string         `json:"state"`    // `running/succeeded/rolled-back/aborted`
+    Reason   string         `json:"reason"`   // why the rollout is rolled back or aborted
+    Step     int            `json:"step"`     // index of the current step
+    Started  time.Time      `json:"started"`
+    Finished time.Time      `json:"finished"`
+    History  []*RolloutStep `json:"history"`
+    split    *Split         // split of the service before the rollout, restored unless it succeeds
+    stop     chan struct{}
+}
+
+func (r *Rollout) Validate() error {
+    if len(r.Pool) == 0 {
+        r.Pool = "gray"
+    }
+
+    if len(r.Steps) == 0 {
+        r.Steps = []float64{1, 5, 25, 50, 100}
+    }
+
+    last := 0.0
+    for _, step := range r.Steps {
+        if step <= last || step > 100 {
+            return fmt.Errorf("steps must increase within 0 ~ 100")
+        }
+        last = step
+    }
+
+    if r.Interval <= 0 {
+        r.Interval = 60
+    }
+
+    if r.MinRequests <= 0 {
+        r.MinRequests = 20
+    }
+
+    if r.MaxErrorRate <= 0 {
+        r.MaxErrorRate = 0.01
+    }
+
+    if r.MaxLatency <= 0 {
+        r.MaxLatency = 1.5
+    }
+
+    return (&Split{Pool: r.Pool, Sticky: r.Sticky}).Validate()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func milliseconds(d time.Duration) float64 {
+    return float64(d) / float64(time.Millisecond)
+}
+
+// judge fills the step with the traffic of both pools since the step began,
+// it returns false if the gray pool has not taken enough requests yet. Gray
+// traffic is that of the split share only, requests matching the pattern of
+// the pool do not tell how the share does.
+func (st *RolloutStatus) judge(step *RolloutStep, gray0, gray, prod0, prod trafficStats) bool {
+    var grayLatency, prodLatency time.Duration
+    step.GrayRequests, step.GrayErrorRate, grayLatency = gray.since(gray0)
+    step.ProdRequests, step.ProdErrorRate, prodLatency = prod.since(prod0)
+    step.GrayLatency = milliseconds(grayLatency)
+    step.ProdLatency = milliseconds(prodLatency)
+
+    if step.GrayRequests < int64(st.Rollout.MinRequests) {
+        return false
+    }
+
+    step.Result = "passed"
+    if step.GrayErrorRate-step.ProdErrorRate > st.Rollout.MaxErrorRate {
+        step.Result = "failed"
+        st.Reason = fmt.Sprintf("gray error rate %.4f over prod %.4f", step.GrayErrorRate, step.ProdErrorRate)
+    } else if step.ProdRequests > 0 && float64(grayLatency) > float64(prodLatency)*st.Rollout.MaxLatency {
+        step.Result = "failed"
+        st.Reason = fmt.Sprintf("gray latency %.1fms over prod %.1fms", step.GrayLatency, step.ProdLatency)
+    }
+
+    step.Finished = time.Now()
+    return true
+}
+
+// finish ends the rollout and takes the gray share back, the split of the
+// service before the rollout is restored unless it succeeded. The caller holds
+// the proxy lock.
+func (s *Service) finish(st *RolloutStatus, state, reason string) {
+    if st.State != "running" {
+        return
+    }
+
+    st.State = state
+    if len(reason) > 0 {
+        st.Reason = reason
+    }
+    st.Finished = time.Now()
+    close(st.stop)
+
+    if n := len(st.History); n > 0 && st.History[n-1].Result == "running" {
+        st.History[n-1].Result = "aborted"
+        st.History[n-1].Finished = st.Finished
+    }
+
+    s.Split = st.split
+    if state == "succeeded" {
+        s.Split = nil
+    }
+}
+
+func (s *Service) rollout() *RolloutStatus {
+    if len(s.Rollouts) == 0 {
+        return nil
+    }
+
+    return s.Rollouts[len(s.Rollouts)-1]
+}
+
+// stopRollout aborts the running rollout of the service, the caller holds
+// the proxy lock.
+func (s *Service) stopRollout(reason string) {
+    if st := s.rollout(); st != nil {
+        s.finish(st, "aborted", reason)
+    }
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func (p *Proxy) runRollout(s *Service, st *RolloutStatus) {
+    interval := time.Duration(st.Rollout.Interval) * p.second
+
+    for i, gray := range st.Rollout.Steps {
+        p.Lock()
+        if st.State != "running" {
+            p.Unlock()
+            return
+        }
+
+        grayPool, prodPool := s.pool(st.Rollout.Pool), s.defaultPool()
+        if grayPool == nil || prodPool == nil {
+            s.finish(st, "rolled-back", "canary or default pool deleted")
+            p.publish()
+            p.Unlock()
+            return
+        }
+
+        step := &RolloutStep{Gray: gray, Started: time.Now(), Result: "running"}
+        st.Step = i
+        st.History = append(st.History, step)
+        s.Split = &Split{Pool: st.Rollout.Pool, Gray: gray, Sticky: st.Rollout.Sticky}
+        gray0, prod0 := grayPool.splitTraffic.snapshot(), prodPool.traffic.snapshot()
+        p.publish()
+        p.Unlock()
+
+        for round := 1; ; round++ {
+            select {
+            case <-st.stop:
+                return
+            case <-time.After(interval):
+            }
+
+            p.Lock()
+            if st.State != "running" {
+                p.Unlock()
+                return
+            }
+
+            if !st.judge(step, gray0, grayPool.splitTraffic.snapshot(), prod0, prodPool.traffic.snapshot()) {
+                if round < maxRolloutRounds {
+                    p.Unlock()
+                    continue
+                }
+
+                step.Result = "failed"
+                s.finish(st, "rolled-back", "not enough gray traffic")
+                p.publish()
+                p.Unlock()
+                return
+            }
+
+            if step.Result == "failed" {
+                log.Printf("rollout of service %s rolled back at %v%%: %s", s.Name, gray, st.Reason)
+                s.finish(st, "rolled-back", "")
+                p.publish()
+                p.Unlock()
+                return
+            }
+
+            p.Unlock()
+            break
+        }
+    }
+
+    p.Lock()
+    defer p.Unlock()
+    defer p.publish()
+
+    if st.State != "running" {
+        return
+    }
+
+    if err := s.promote(st.Rollout.Pool, false); err != nil {
+        s.finish(st, "rolled-back", err.Error())
+        return
+    }
+
+    log.Printf("rollout of service %s succeeded, nodes of pool %s promoted", s.Name, st.Rollout.Pool)
+    s.finish(st, "succeeded", "")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// newRolloutProxy returns a proxy with node p1 in prod and node g1 in gray
+// served by the handler given.
+func newRolloutProxy(t *testing.T, gray http.HandlerFunc) *Proxy {
+    prod := startBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+    p := newTestProxy(t, &Node{Name: "p1", Host: prod, Status: "on"})
+    p.second = time.Millisecond // rollout intervals in milliseconds
+    addNode(t, p, "gray", &Node{Name: "g1", Host: startBackend(t, gray), Status: "on"})
+    return p
+}
+
+// driveTraffic sends requests through the proxy until the returned func is called.
+func driveTraffic(p *Proxy, header http.Header) func() {
+    stop := make(chan struct{})
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-time.After(200 * time.Microsecond):
+            }
+
+            req := httptest.NewRequest("GET", "/", nil)
+            copyHeader(req.Header, header)
+            p.ServeHTTP(httptest.NewRecorder(), req)
+        }
+    }()
+
+    return func() {
+        close(stop)
+        wg.Wait()
+    }
+}
+
+func startRollout(t *testing.T, p *Proxy, r *Rollout) {
+    validated(t, r)
+
+    if err := p.PostServiceRollout("s", r); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func waitRollout(t *testing.T, p *Proxy) *RolloutStatus {
+    for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(5 * time.Millisecond) {
+        if st, _ := p.GetServiceRollout("s"); st.State != "running" {
+            return st
+        }
+    }
+
+    t.Fatal("rollout still running")
+    return nil
+}
+
+func prodNodes(p *Proxy) string {
+    nodes, _ := p.ListServicePoolNode("s", "prod")
+    names := make([]string, len(nodes))
+    for i, node := range nodes {
+        names[i] = node.Name
+    }
+
+    return strings.Join(names, ",")
+}
+
+func TestRolloutSucceeds(t *testing.T) {
+    p := newRolloutProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+    stop := driveTraffic(p, nil)
+    defer stop()
+
+    // sub-millisecond latencies of the test backends are too noisy to compare
+    startRollout(t, p, &Rollout{Steps: []float64{50, 100}, MinRequests: 5, MaxLatency: 100, Interval: 30})
+    st := waitRollout(t, p)
+    if st.State != "succeeded" || len(st.History) != 2 {
+        t.Fatalf("rollout = %+v", st)
+    }
+
+    for i, step := range st.History {
+        if step.Result != "passed" || step.GrayRequests < 5 {
+            t.Errorf("step %d = %+v", i, step)
+        }
+    }
+
+    if nodes := prodNodes(p); nodes != "g1" {
+        t.Errorf("prod nodes = %s, want g1 promoted", nodes)
+    }
+
+    if split, _ := p.GetServiceSplit("s"); split.Gray != 0 {
+        t.Errorf("split after the rollout = %+v, want none", split)
+    }
+}
+
+func TestRolloutRollsBackOnErrors(t *testing.T) {
+    p := newRolloutProxy(t, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) })
+    p.PutServiceSplit("s", &Split{Pool: "gray", Gray: 1})
+    stop := driveTraffic(p, nil)
+    defer stop()
+
+    startRollout(t, p, &Rollout{Steps: []float64{50, 100}, MinRequests: 5, Interval: 30})
+    st := waitRollout(t, p)
+    if st.State != "rolled-back" || !strings.Contains(st.Reason, "error rate") || st.History[0].Result != "failed" {
+        t.Fatalf("rollout = %+v", st)
+    }
+
+    if nodes := prodNodes(p); nodes != "p1" {
+        t.Errorf("prod nodes = %s, want p1 kept", nodes)
+    }
+
+    if split, _ := p.GetServiceSplit("s"); split.Gray != 1 {
+        t.Errorf("split after the rollout = %+v, want the one before restored", split)
+    }
+}
+
+func TestRolloutRollsBackOnLatency(t *testing.T) {
+    p := newRolloutProxy(t, func(w http.ResponseWriter, r *http.Request) { time.Sleep(20 * time.Millisecond) })
+    stop := driveTraffic(p, nil)
+    defer stop()
+
+    startRollout(t, p, &Rollout{Steps: []float64{50, 100}, MinRequests: 3, Interval: 100})
+    st := waitRollout(t, p)
+    if st.State != "rolled-back" || !strings.Contains(st.Reason, "latency") {
+        t.Fatalf("rollout = %+v", st)
+    }
+}
+
+func TestRolloutAbortsWithoutTraffic(t *testing.T) {
+    p := newRolloutProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+
+    startRollout(t, p, &Rollout{Steps: []float64{50}, Interval: 5})
+    st := waitRollout(t, p)
+    if st.State != "rolled-back" || st.Reason != "not enough gray traffic" {
+        t.Fatalf("rollout = %+v", st)
+    }
+}
+
+func TestRolloutIgnoresPatternTraffic(t *testing.T) {
+    p := newRolloutProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+    pattern := validated(t, &Pattern{Type: "header", Name: "X-Gray"})
+    p.PutServicePool("s", "gray", &Pool{Priority: priority(10), LBPolicy: "random", Pattern: pattern}, 0)
+
+    // every request goes to gray by the pattern, none by the share
+    stop := driveTraffic(p, http.Header{"X-Gray": {"1"}})
+    defer stop()
+
+    startRollout(t, p, &Rollout{Steps: []float64{50}, MinRequests: 5, Interval: 10})
+    st := waitRollout(t, p)
+    if st.State != "rolled-back" || st.Reason != "not enough gray traffic" {
+        t.Fatalf("rollout = %+v", st)
+    }
+}
+
+func TestRolloutRejectsSplit(t *testing.T) {
+    p := newRolloutProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+    p.PutServiceSplit("s", &Split{Pool: "gray", Gray: 1})
+
+    startRollout(t, p, &Rollout{Steps: []float64{50}, Interval: 3600000})
+    if err := p.PutServiceSplit("s", &Split{Pool: "gray", Gray: 10}); err == nil {
+        t.Error("split changed while the rollout runs")
+    }
+
+    if err := p.DeleteServiceRollout("s"); err != nil {
+        t.Fatal(err)
+    }
+
+    if split, _ := p.GetServiceSplit("s"); split.Gray != 1 {
+        t.Errorf("split after the abort = %+v, want the one before restored", split)
+    }
+
+    if err := p.PutServiceSplit("s", &Split{Pool: "gray", Gray: 10}); err != nil {
+        t.Errorf("split after the abort: %v", err)
+    }
+}
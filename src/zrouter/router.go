@@ -17,7 +17,11 @@ type Route struct {
 }
 
 var routes = []Route{
-    Route{"GET", "/api/ping", Ping},
+    Route{"GET", "/api/ping",    Ping   },
+    Route{"GET", "/api/metrics", Metrics},
+
+    Route{"POST", "/api/route-test", RouteTest},
+    Route{"POST", "/api/batch",      Batch    },
 
     Route{"GET",    "/api/services",           ListService  },
     Route{"POST",   "/api/services",           PostService  },
@@ -26,15 +30,53 @@ var routes = []Route{
     Route{"DELETE", "/api/services/{service}", DeleteService},
 
     Route{"GET",    "/api/services/{service}/pools",        ListServicePool  },
+    Route{"POST",   "/api/services/{service}/pools",        PostServicePool  },
     Route{"GET",    "/api/services/{service}/pools/{pool}", GetServicePool   },
     Route{"PUT",    "/api/services/{service}/pools/{pool}", PutServicePool   },
     Route{"DELETE", "/api/services/{service}/pools/{pool}", DeleteServicePool},
 
+    Route{"GET",    "/api/services/{service}/split", GetServiceSplit   },
+    Route{"PUT",    "/api/services/{service}/split", PutServiceSplit   },
+    Route{"DELETE", "/api/services/{service}/split", DeleteServiceSplit},
+
+    Route{"GET",    "/api/services/{service}/rollout",  GetServiceRollout   },
+    Route{"POST",   "/api/services/{service}/rollout",  PostServiceRollout  },
+    Route{"DELETE", "/api/services/{service}/rollout",  DeleteServiceRollout},
+    Route{"GET",    "/api/services/{service}/rollouts", ListServiceRollout  },
+
+    Route{"GET",    "/api/services/{service}/promote",  GetServicePromotion},
+    Route{"POST",   "/api/services/{service}/promote",  PromoteService     },
+    Route{"POST",   "/api/services/{service}/rollback", RollbackService    },
+
+    Route{"GET",    "/api/services/{service}/headers", GetServiceHeaders   },
+    Route{"PUT",    "/api/services/{service}/headers", PutServiceHeaders   },
+    Route{"DELETE", "/api/services/{service}/headers", DeleteServiceHeaders},
+
+    Route{"GET",    "/api/services/{service}/mirror", GetServiceMirror   },
+    Route{"PUT",    "/api/services/{service}/mirror", PutServiceMirror   },
+    Route{"DELETE", "/api/services/{service}/mirror", DeleteServiceMirror},
+
+    Route{"GET",    "/api/services/{service}/breaker",       GetServiceBreaker   },
+    Route{"PUT",    "/api/services/{service}/breaker",       PutServiceBreaker   },
+    Route{"DELETE", "/api/services/{service}/breaker",       DeleteServiceBreaker},
+    Route{"POST",   "/api/services/{service}/breaker/trip",  TripServiceBreaker  },
+    Route{"POST",   "/api/services/{service}/breaker/reset", ResetServiceBreaker },
+
+    Route{"GET",    "/api/services/{service}/ratelimits",             ListServiceRateLimit  },
+    Route{"POST",   "/api/services/{service}/ratelimits",             PostServiceRateLimit  },
+    Route{"GET",    "/api/services/{service}/ratelimits/{ratelimit}", GetServiceRateLimit   },
+    Route{"PUT",    "/api/services/{service}/ratelimits/{ratelimit}", PutServiceRateLimit   },
+    Route{"DELETE", "/api/services/{service}/ratelimits/{ratelimit}", DeleteServiceRateLimit},
+
     Route{"GET",    "/api/services/{service}/pools/{pool}/nodes",        ListServicePoolNode  },
     Route{"POST",   "/api/services/{service}/pools/{pool}/nodes",        PostServicePoolNode  },
     Route{"GET",    "/api/services/{service}/pools/{pool}/nodes/{node}", GetServicePoolNode   },
     Route{"PUT",    "/api/services/{service}/pools/{pool}/nodes/{node}", PutServicePoolNode   },
     Route{"DELETE", "/api/services/{service}/pools/{pool}/nodes/{node}", DeleteServicePoolNode},
+
+    Route{"GET",    "/api/services/{service}/pools/{pool}/nodes/{node}/breaker",       GetServicePoolNodeBreaker  },
+    Route{"POST",   "/api/services/{service}/pools/{pool}/nodes/{node}/breaker/trip",  TripServicePoolNodeBreaker },
+    Route{"POST",   "/api/services/{service}/pools/{pool}/nodes/{node}/breaker/reset", ResetServicePoolNodeBreaker},
 }
 
 type InnerResponseWriter struct {
@@ -71,7 +113,7 @@ func wrapper(inner http.HandlerFunc) http.HandlerFunc {
                 debug.PrintStack()
                 wr.WriteHeader(http.StatusInternalServerError)
                 log.Printf("Panic: %v\n", err)
-                fmt.Fprintf(w, fmt.Sprintln(err))
+                fmt.Fprintln(w, err)
             }
 
             d := time.Now().Sub(s)
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "net/http"
+    "sort"
+    "strings"
+)
+
+// routeTable is the precompiled lookup of services by host and Url prefix,
+// it is rebuilt on every change of the services and never modified after.
+type routeTable struct {
+    hosts *hostRoutes
+}
+
+// radixNode is a node of a radix tree of Url prefixes, services are those
+// whose Url ends at this node, in descending priority.
+type radixNode struct {
+    prefix   string
+    services []*Service
+    children []*radixNode
+}
+
+func newRouteTable(services []*Service) *routeTable {
+    return &routeTable{hosts: newHostRoutes(services)}
+}
+
+// lookup returns the service with the longest Url prefixing the path, among
+// the services of the first host matching, see hostRoutes.
+func (t *routeTable) lookup(req *http.Request) *Service {
+    root := t.hosts.match(req)
+    if root == nil {
+        return nil
+    }
+
+    return root.lookup(req)
+}
+
+func commonPrefix(a, b string) int {
+    i := 0
+    for i < len(a) && i < len(b) && a[i] == b[i] {
+        i++
+    }
+
+    return i
+}
+
+// insert adds the service under key, services of the same priority keep the
+// order they are inserted in.
+func (n *radixNode) insert(key string, s *Service) {
+    for len(key) > 0 {
+        var child *radixNode
+        var i int
+        for i = range n.children {
+            if n.children[i].prefix[0] == key[0] {
+                child = n.children[i]
+                break
+            }
+        }
+
+        if child == nil {
+            n.children = append(n.children, &radixNode{prefix: key, services: []*Service{s}})
+            return
+        }
+
+        l := commonPrefix(key, child.prefix)
+        if l < len(child.prefix) {
+            split := &radixNode{prefix: child.prefix[:l], children: []*radixNode{child}}
+            child.prefix = child.prefix[l:]
+            n.children[i] = split
+            child = split
+        }
+
+        key = key[l:]
+        n = child
+    }
+
+    n.services = append(n.services, s)
+    sort.SliceStable(n.services, func(i, j int) bool {
+        return n.services[i].Priority > n.services[j].Priority
+    })
+}
+
+// lookup returns the first service matching the request at the node of the
+// longest Url prefixing the path, shorter prefixes are tried if none matches.
+func (n *radixNode) lookup(req *http.Request) *Service {
+    path := req.URL.Path
+    nodes := []*radixNode{n}
+    for len(path) > 0 {
+        var next *radixNode
+        for _, child := range n.children {
+            if child.prefix[0] == path[0] {
+                if strings.HasPrefix(path, child.prefix) {
+                    next = child
+                }
+                break
+            }
+        }
+
+        if next == nil {
+            break
+        }
+
+        path = path[len(next.prefix):]
+        n = next
+        nodes = append(nodes, n)
+    }
+
+    for i := len(nodes) - 1; i >= 0; i-- {
+        for _, s := range nodes[i].services {
+            if s.matches(req) {
+                return s
+            }
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "fmt"
+    "net/http/httptest"
+    "testing"
+)
+
+func mustRouteTable(t testing.TB, services []*Service) *routeTable {
+    for _, s := range services {
+        if err := s.parseHosts(); err != nil {
+            t.Fatalf("parseHosts(%s): %v", s.Name, err)
+        }
+    }
+
+    return newRouteTable(services)
+}
+
+func TestRouteTableLookup(t *testing.T) {
+    services := []*Service{
+        {Name: "root", Url: "/"},
+        {Name: "api", Url: "/api/"},
+        {Name: "api-v2", Url: "/api/v2/"},
+        {Name: "apix", Url: "/apix"},
+        {Name: "dup", Url: "/api/"}, // same priority, the first one wins
+        {Name: "admin", Host: "admin.example.com", Url: "/admin/"},
+        {Name: "admin-root", Host: "admin.example.com", Url: "/"},
+        {Name: "shop", Host: "shop.example.com", Url: "/shop/"},
+    }
+    table := mustRouteTable(t, services)
+
+    tests := []struct {
+        host, path, want string
+    }{
+        {"www.example.com", "/", "root"},
+        {"www.example.com", "/index.html", "root"},
+        {"www.example.com", "/api", "root"},
+        {"www.example.com", "/api/users", "api"},
+        {"www.example.com", "/api/v2/users", "api-v2"},
+        {"www.example.com", "/api/v3/users", "api"},
+        {"www.example.com", "/apix/a", "apix"},
+        {"www.example.com:8080", "/api/v2/", "api-v2"},
+        {"admin.example.com", "/admin/users", "admin"},
+        {"admin.example.com", "/api/users", "admin-root"},
+        {"admin.example.com:443", "/admin/", "admin"},
+        {"shop.example.com", "/shop/cart", "shop"},
+        {"shop.example.com", "/api/users", ""}, // the host has services, no fallback to catch-all
+    }
+
+    for _, test := range tests {
+        req := httptest.NewRequest("GET", test.path, nil)
+        req.Host = test.host
+
+        got := ""
+        if s := table.lookup(req); s != nil {
+            got = s.Name
+        }
+
+        if got != test.want {
+            t.Errorf("lookup(%s%s) = %q, want %q", test.host, test.path, got, test.want)
+        }
+    }
+}
+
+func TestRouteTableEmpty(t *testing.T) {
+    table := newRouteTable(nil)
+    if s := table.lookup(httptest.NewRequest("GET", "/", nil)); s != nil {
+        t.Errorf("lookup of empty table = %s, want nil", s.Name)
+    }
+}
+
+func benchmarkLookup(b *testing.B, n int) {
+    services := make([]*Service, 0, n)
+    for i := 0; i < n; i++ {
+        services = append(services, &Service{
+            Name: fmt.Sprintf("s%d", i),
+            Host: fmt.Sprintf("h%d.example.com", i%10),
+            Url:  fmt.Sprintf("/app%d/", i),
+        })
+    }
+    table := mustRouteTable(b, services)
+
+    req := httptest.NewRequest("GET", fmt.Sprintf("/app%d/users/42", n-1), nil)
+    req.Host = fmt.Sprintf("h%d.example.com", (n-1)%10)
+
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        if table.lookup(req) == nil {
+            b.Fatal("no service found")
+        }
+    }
+}
+
+func BenchmarkLookup10(b *testing.B)    { benchmarkLookup(b, 10) }
+func BenchmarkLookup100(b *testing.B)   { benchmarkLookup(b, 100) }
+func BenchmarkLookup1000(b *testing.B)  { benchmarkLookup(b, 1000) }
+func BenchmarkLookup10000(b *testing.B) { benchmarkLookup(b, 10000) }
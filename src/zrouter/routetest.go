@@ -0,0 +1,140 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+)
+
+type RouteTestRequest struct {
+    Method   string            `json:"method"`    // `GET` by default
+    Host     string            `json:"host"`      // Host header, port included if any
+    Path     string            `json:"path"`      // path and query, `/` by default
+    Headers  map[string]string `json:"headers"`
+    ClientIP string            `json:"client_ip"` // remote address of the request, `127.0.0.1` by default
+}
+
+type PatternResult struct {
+    Pool    string `json:"pool"`
+    Matched bool   `json:"matched"`
+}
+
+type NodeCandidate struct {
+    Name      string `json:"name"`
+    Host      string `json:"host"`
+    Status    string `json:"status"`
+    ConnNum   int    `json:"conn_num"`
+    MaxConns  int    `json:"max_conns"`
+    Breaker   string `json:"breaker"`   // `closed/open/half-open`
+    Available bool   `json:"available"` // whether the node may be picked now
+}
+
+type RouteExplain struct {
+    Service  string           `json:"service"`
+    Action   string           `json:"action"`   // `proxy/redirect/response/maintenance`
+    Pool     string           `json:"pool"`     // pool taking the request if proxied
+    Reason   string           `json:"reason"`   // why the pool takes it
+    Patterns []*PatternResult `json:"patterns"` // patterns of the pools other than the default one, in match order
+    Nodes    []*NodeCandidate `json:"nodes"`    // nodes of the pool
+}
+
+// request builds the request described, it is never sent.
+func (t *RouteTestRequest) request() (*http.Request, error) {
+    if len(t.Method) == 0 {
+        t.Method = "GET"
+    }
+
+    if len(t.Path) == 0 {
+        t.Path = "/"
+    }
+
+    if !strings.HasPrefix(t.Path, "/") {
+        return nil, fmt.Errorf("path must start with /")
+    }
+
+    if len(t.ClientIP) == 0 {
+        t.ClientIP = "127.0.0.1"
+    }
+
+    if net.ParseIP(t.ClientIP) == nil {
+        return nil, fmt.Errorf("invalid client ip %q", t.ClientIP)
+    }
+
+    req, err := http.NewRequest(strings.ToUpper(t.Method), t.Path, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    req.Host = t.Host
+    req.RemoteAddr = net.JoinHostPort(t.ClientIP, "0")
+    for k, v := range t.Headers {
+        req.Header.Set(k, v)
+    }
+
+    return req, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RouteTest explains how ServeHTTP would route the request, without sending
+// it anywhere. Splits without a sticky key are random, so is their result.
+func (p *Proxy) RouteTest(req *http.Request) (*RouteExplain, error) {
+    s := p.lookup(req)
+    if s == nil {
+        return nil, fmt.Errorf("no service matches host %q and path %q", req.Host, req.URL.Path)
+    }
+
+    e := &RouteExplain{Service: s.Name, Action: "proxy", Patterns: make([]*PatternResult, 0), Nodes: make([]*NodeCandidate, 0)}
+
+    switch {
+    case s.Maintenance != nil && s.Maintenance.Enabled && (s.Maintenance.Allow == nil || !s.Maintenance.Allow.Match(req)):
+        e.Action = "maintenance"
+        return e, nil
+    case s.Redirect != nil:
+        e.Action = "redirect"
+        return e, nil
+    case s.Response != nil:
+        e.Action = "response"
+        return e, nil
+    }
+
+    for _, pool := range s.Pools {
+        if pool.Name != s.DefaultPool && pool.Pattern != nil {
+            e.Patterns = append(e.Patterns, &PatternResult{Pool: pool.Name, Matched: pool.Pattern.Match(req)})
+        }
+    }
+
+    pool, reason := p.lookupPool(s, req)
+    if pool == nil {
+        return nil, fmt.Errorf("pool of service %s not found", s.Name)
+    }
+
+    e.Pool = pool.Name
+    switch reason {
+    case "maintenance":
+        e.Reason = fmt.Sprintf("under maintenance, allowed requests go to pool %s", pool.Name)
+    case "pattern":
+        e.Reason = fmt.Sprintf("pattern of pool %s matched", pool.Name)
+    case "split":
+        e.Reason = fmt.Sprintf("split of %v%% to pool %s", s.Split.Gray, pool.Name)
+    default:
+        e.Reason = "default pool, no pattern or split matched"
+    }
+
+    now := time.Now()
+    for _, node := range pool.Nodes {
+        e.Nodes = append(e.Nodes, &NodeCandidate{
+            Name:      node.Name,
+            Host:      node.Host,
+            Status:    node.Status,
+            ConnNum:   node.connNum(),
+            MaxConns:  node.MaxConns,
+            Breaker:   node.circuit.Status().State,
+            Available: node.available(now),
+        })
+    }
+
+    return e, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestRouteTestExplain(t *testing.T) {
+    p := newTestProxy(t, &Node{Name: "n1", Host: "127.0.0.1:1", Status: "on"})
+    p.PostServicePoolNode("s", "gray", &Node{Name: "g1", Host: "127.0.0.1:2", Status: "off"})
+
+    pattern := validated(t, &Pattern{Type: "ip", Values: []string{"10.0.0.0/8"}})
+    if err := p.PutServicePool("s", "gray", &Pool{Priority: priority(10), LBPolicy: "random", Pattern: pattern}, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        clientIP, pool, node string
+        available            bool
+    }{
+        {"10.1.2.3", "gray", "g1", false},
+        {"192.168.0.1", "prod", "n1", true},
+    }
+
+    for _, test := range tests {
+        req, err := (&RouteTestRequest{Path: "/a?b=1", ClientIP: test.clientIP}).request()
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        e, err := p.RouteTest(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if e.Service != "s" || e.Action != "proxy" || e.Pool != test.pool {
+            t.Errorf("%s: explained %+v, want pool %s", test.clientIP, e, test.pool)
+            continue
+        }
+
+        if len(e.Patterns) != 1 || e.Patterns[0].Matched != (test.pool == "gray") {
+            t.Errorf("%s: patterns %+v", test.clientIP, e.Patterns)
+        }
+
+        if len(e.Nodes) != 1 || e.Nodes[0].Name != test.node || e.Nodes[0].Available != test.available {
+            t.Errorf("%s: nodes %+v, want %s available %v", test.clientIP, e.Nodes, test.node, test.available)
+        }
+    }
+}
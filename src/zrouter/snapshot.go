@@ -0,0 +1,128 @@
+package main
+
+import (
+    "sync/atomic"
+)
+
+// Admin calls change the services under the proxy lock and publish a copy of
+// them afterwards, ServeHTTP only reads the published copy and never takes
+// the lock. The copies share the runtime state, connection counters, queues,
+// breakers and traffic stats, with the services they are taken from.
+
+// nodeState is the runtime state of a node shared by its copies.
+type nodeState struct {
+    conns     int64 // requests in flight
+    unloading int32 // 1 if the node is unloading, so the last request turns it off
+}
+
+func (n *Node) connNum() int {
+    return int(atomic.LoadInt64(&n.state.conns))
+}
+
+// take counts a request on the node unless it reaches its max_conns.
+func (n *Node) take() bool {
+    for {
+        conns := atomic.LoadInt64(&n.state.conns)
+        if n.MaxConns > 0 && conns >= int64(n.MaxConns) {
+            return false
+        }
+
+        if atomic.CompareAndSwapInt64(&n.state.conns, conns, conns+1) {
+            return true
+        }
+    }
+}
+
+// release gives back the request counted by take, it returns true if the
+// node is unloading and has no request in flight any more.
+func (n *Node) release() bool {
+    return atomic.AddInt64(&n.state.conns, -1) == 0 && atomic.LoadInt32(&n.state.unloading) == 1
+}
+
+// setStatus changes the status of the node, an unloading node without
+// requests in flight turns off at once. The caller holds the proxy lock.
+func (n *Node) setStatus(status string) {
+    if n.Status != status {
+        n.Version = nextVersion()
+    }
+
+    n.Status = status
+    if status != "unloading" {
+        atomic.StoreInt32(&n.state.unloading, 0)
+        return
+    }
+
+    atomic.StoreInt32(&n.state.unloading, 1)
+    if atomic.LoadInt64(&n.state.conns) == 0 {
+        n.setStatus("off")
+    }
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func (n *Node) clone() *Node {
+    c := *n
+    return &c
+}
+
+func (p *Pool) clone() *Pool {
+    c := *p
+    c.Nodes = make([]*Node, len(p.Nodes))
+    for i, node := range p.Nodes {
+        c.Nodes[i] = node.clone()
+    }
+
+    return &c
+}
+
+// clone copies the service and its pools and nodes, the other configs are
+// replaced rather than modified by the admin calls, so they are shared.
+func (s *Service) clone() *Service {
+    c := *s
+    c.Pools = make([]*Pool, len(s.Pools))
+    for i, pool := range s.Pools {
+        c.Pools[i] = pool.clone()
+    }
+
+    return &c
+}
+
+// publish swaps in a copy of the services for ServeHTTP and hands the nodes
+// of the new copy to the requests waiting in the pool queues. The caller
+// holds the proxy lock.
+func (p *Proxy) publish() {
+    services := make([]*Service, len(p.Services))
+    for i, s := range p.Services {
+        services[i] = s.clone()
+    }
+
+    p.routes.Store(newRouteTable(services))
+
+    for _, s := range services {
+        for _, pool := range s.Pools {
+            pool.queue.publish(pool)
+        }
+    }
+}
+
+// settle turns off the unloading nodes without requests in flight, those
+// kept aside by the last promotion included. The caller holds the proxy lock.
+func (p *Proxy) settle() {
+    for _, s := range p.Services {
+        for _, pool := range s.Pools {
+            settleNodes(pool.Nodes)
+        }
+
+        if s.Promotion != nil {
+            settleNodes(s.Promotion.Previous)
+        }
+    }
+}
+
+func settleNodes(nodes []*Node) {
+    for _, node := range nodes {
+        if node.Status == "unloading" {
+            node.setStatus("unloading")
+        }
+    }
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "fmt"
+    "hash/fnv"
+    "math/rand"
+    "net/http"
+    "strings"
+)
+
+type Split struct {
+    Pool   string  `json:"pool"`   // pool taking the share, `gray` by default
+    Gray   float64 `json:"gray"`   // percentage of the requests going to the pool, `0 ~ 100`
+    Sticky string  `json:"sticky"` // `ip`, `header:<name>` or `cookie:<name>` keeping a client on one side, random if empty
+}
+
+func (s *Split) Validate() error {
+    if len(s.Pool) == 0 {
+        s.Pool = "gray"
+    }
+
+    if s.Gray < 0 || s.Gray > 100 {
+        return fmt.Errorf("invalid gray percentage %v", s.Gray)
+    }
+
+    if len(s.Sticky) == 0 || s.Sticky == "ip" {
+        return nil
+    }
+
+    i := strings.Index(s.Sticky, ":")
+    if i < 0 || i == len(s.Sticky)-1 {
+        return fmt.Errorf("invalid sticky key %q", s.Sticky)
+    }
+
+    if kind := s.Sticky[:i]; kind != "header" && kind != "cookie" {
+        return fmt.Errorf("invalid sticky key %q", s.Sticky)
+    }
+
+    return nil
+}
+
+// key returns the value the request is stuck by, false if the request does
+// not carry it.
+func (s *Split) key(req *http.Request) (string, bool) {
+    if s.Sticky == "ip" {
+        if ip := clientIP(req); ip != nil {
+            return ip.String(), true
+        }
+        return "", false
+    }
+
+    i := strings.Index(s.Sticky, ":")
+    if i < 0 {
+        return "", false
+    }
+
+    name := s.Sticky[i+1:]
+    switch s.Sticky[:i] {
+    case "header":
+        v := req.Header.Get(name)
+        return v, len(v) > 0
+    case "cookie":
+        if c, err := req.Cookie(name); err == nil && len(c.Value) > 0 {
+            return c.Value, true
+        }
+    }
+
+    return "", false
+}
+
+// gray tells whether the request falls into the gray share, the same key
+// always falls on the same side as long as the share does not shrink.
+func (s *Split) gray(req *http.Request) bool {
+    if s.Gray <= 0 {
+        return false
+    }
+
+    var n uint32
+    if key, ok := s.key(req); ok {
+        h := fnv.New32a()
+        h.Write([]byte(key))
+        n = h.Sum32() % 10000
+    } else {
+        n = uint32(rand.Intn(10000))
+    }
+
+    return float64(n) < s.Gray*100
+}
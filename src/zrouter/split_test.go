@@ -0,0 +1,100 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func grayShare(s *Split, n int, request func(i int) *http.Request) float64 {
+    gray := 0
+    for i := 0; i < n; i++ {
+        if s.gray(request(i)) {
+            gray++
+        }
+    }
+
+    return float64(gray) * 100 / float64(n)
+}
+
+func TestSplitShare(t *testing.T) {
+    random := func(i int) *http.Request { return httptest.NewRequest("GET", "/", nil) }
+    byHeader := func(i int) *http.Request {
+        req := httptest.NewRequest("GET", "/", nil)
+        req.Header.Set("X-User", fmt.Sprint("user-", i))
+        return req
+    }
+
+    for _, gray := range []float64{0, 5, 30, 100} {
+        for _, sticky := range []string{"", "header:X-User"} {
+            request := random
+            if len(sticky) > 0 {
+                request = byHeader
+            }
+
+            share := grayShare(validated(t, &Split{Gray: gray, Sticky: sticky}), 5000, request)
+            if math.Abs(share-gray) > 2.5 {
+                t.Errorf("share of gray %v sticky %q = %.2f", gray, sticky, share)
+            }
+        }
+    }
+}
+
+func TestSplitSticky(t *testing.T) {
+    for _, c := range []struct {
+        sticky string
+        set    func(req *http.Request, key string)
+    }{
+        {"ip", func(req *http.Request, key string) { req.RemoteAddr = key + ":1000" }},
+        {"header:X-User", func(req *http.Request, key string) { req.Header.Set("X-User", key) }},
+        {"cookie:uid", func(req *http.Request, key string) { req.AddCookie(&http.Cookie{Name: "uid", Value: key}) }},
+    } {
+        small := validated(t, &Split{Gray: 20, Sticky: c.sticky})
+        large := validated(t, &Split{Gray: 60, Sticky: c.sticky})
+        for i := 0; i < 200; i++ {
+            key := fmt.Sprintf("10.0.%d.%d", i/100, i%100)
+            side := func(s *Split) bool {
+                req := httptest.NewRequest("GET", "/", nil)
+                c.set(req, key)
+                return s.gray(req)
+            }
+
+            first := side(small)
+            for j := 0; j < 5; j++ {
+                if side(small) != first {
+                    t.Fatalf("%s key %s switched sides", c.sticky, key)
+                }
+            }
+
+            // growing the share only moves keys into gray
+            if first && !side(large) {
+                t.Errorf("%s key %s left gray when the share grew", c.sticky, key)
+            }
+        }
+    }
+}
+
+func TestSplitValidate(t *testing.T) {
+    for _, s := range []*Split{
+        {Gray: -1},
+        {Gray: 101},
+        {Gray: 10, Sticky: "header"},
+        {Gray: 10, Sticky: "header:"},
+        {Gray: 10, Sticky: "query:uid"},
+    } {
+        if err := s.Validate(); err == nil {
+            t.Errorf("Validate(%+v) succeeded, want error", s)
+        }
+    }
+
+    if s := validated(t, &Split{Gray: 10}); s.Pool != "gray" {
+        t.Errorf("pool = %q, want gray by default", s.Pool)
+    }
+
+    p := newTestProxy(t)
+    if err := p.PutServiceSplit("s", validated(t, &Split{Pool: "nope", Gray: 50})); err == nil {
+        t.Error("split to a missing pool accepted")
+    }
+}
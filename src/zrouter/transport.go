@@ -0,0 +1,288 @@
+package main
+
+import (
+    "context"
+    "io"
+    "net"
+    "net/http"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type Transport struct {
+    MaxIdleConnsPerHost int  `json:"max_idle_conns_per_host"` // 0 means http.DefaultMaxIdleConnsPerHost
+    MaxConnsPerHost     int  `json:"max_conns_per_host"`      // 0 means no limit
+    IdleTimeout         int  `json:"idle_timeout"`            // seconds, 0 means 90
+    KeepAlive           int  `json:"keep_alive"`              // seconds of tcp keep-alive period, 0 means 30, negative disables
+    DialTimeout         int  `json:"dial_timeout"`            // seconds, 0 means 30
+    DisableKeepAlives   bool `json:"disable_keep_alives"`     // use a new connection for every request
+}
+
+type ConnStats struct {
+    Host       string `json:"host"`
+    Open       int    `json:"open"`        // connections currently open
+    Active     int    `json:"active"`      // requests in flight
+    Idle       int    `json:"idle"`        // open connections without request in flight
+    Dials      int    `json:"dials"`
+    DialErrors int    `json:"dial_errors"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// poolTransport is the upstream transport owned by a single Pool, so that
+// services do not compete for the idle connections of each other. Requests
+// count themselves on the stats of their host without the lock, which only
+// guards adding and dropping hosts.
+type poolTransport struct {
+    *http.Transport
+    sync.Mutex
+    hosts   sync.Map // host => *hostStats
+    retired int32    // 1 once the pool is deleted or reconfigured
+}
+
+// hostStats are the live counters of ConnStats.
+type hostStats struct {
+    open       int64
+    active     int64
+    dials      int64
+    dialErrors int64
+    gone       int32 // 1 once the node is removed, dropped with the last connection
+    host       string
+    conns      map[*trackedConn]bool // open connections, guarded by the transport lock
+}
+
+func seconds(n, def int) time.Duration {
+    if n == 0 {
+        n = def
+    }
+
+    return time.Duration(n) * time.Second
+}
+
+func newPoolTransport(c *Transport) *poolTransport {
+    if c == nil {
+        c = new(Transport)
+    }
+
+    dialer := &net.Dialer{
+        Timeout:   seconds(c.DialTimeout, 30),
+        KeepAlive: seconds(c.KeepAlive, 30),
+    }
+
+    t := new(poolTransport)
+    t.Transport = &http.Transport{
+        Proxy:               http.ProxyFromEnvironment,
+        DialContext:         func(ctx context.Context, network, addr string) (net.Conn, error) { return t.dial(ctx, dialer, network, addr) },
+        MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+        MaxConnsPerHost:     c.MaxConnsPerHost,
+        IdleConnTimeout:     seconds(c.IdleTimeout, 90),
+        DisableKeepAlives:   c.DisableKeepAlives,
+        TLSHandshakeTimeout: 10 * time.Second,
+    }
+
+    return t
+}
+
+func sameTransport(a, b *Transport) bool {
+    if a == nil || b == nil {
+        return a == b
+    }
+
+    return *a == *b
+}
+
+// host returns the stats of addr, the lock is only taken to add the host or
+// to bring back one removed before.
+func (t *poolTransport) host(addr string) *hostStats {
+    if v, ok := t.hosts.Load(addr); ok {
+        if stats := v.(*hostStats); atomic.LoadInt32(&stats.gone) == 0 {
+            return stats
+        }
+    }
+
+    t.Lock()
+    defer t.Unlock()
+
+    v, _ := t.hosts.LoadOrStore(addr, &hostStats{host: addr, conns: make(map[*trackedConn]bool)})
+    stats := v.(*hostStats)
+    atomic.StoreInt32(&stats.gone, 0)
+    return stats
+}
+
+// done is called when a connection closes or a request finishes, it closes
+// the connections of a removed host once its last request finishes and drops
+// its stats once its last connection is gone.
+func (t *poolTransport) done(stats *hostStats, left int64) {
+    if left > 0 || atomic.LoadInt32(&stats.gone) == 0 {
+        return
+    }
+
+    t.Lock()
+    conns := t.drain(stats)
+    t.sweep(stats)
+    t.Unlock()
+
+    closeConns(conns)
+}
+
+// drain returns the connections of a removed host without requests in
+// flight, they are all idle and closed by the caller out of the lock. The
+// caller holds the lock.
+func (t *poolTransport) drain(stats *hostStats) []*trackedConn {
+    if atomic.LoadInt32(&stats.gone) == 0 || atomic.LoadInt64(&stats.active) > 0 {
+        return nil
+    }
+
+    conns := make([]*trackedConn, 0, len(stats.conns))
+    for c := range stats.conns {
+        conns = append(conns, c)
+    }
+
+    return conns
+}
+
+func closeConns(conns []*trackedConn) {
+    for _, c := range conns {
+        c.Close()
+    }
+}
+
+// sweep drops the stats of a removed host without connections, the caller
+// holds the lock.
+func (t *poolTransport) sweep(stats *hostStats) {
+    if atomic.LoadInt32(&stats.gone) == 1 && atomic.LoadInt64(&stats.open) == 0 && atomic.LoadInt64(&stats.active) == 0 {
+        if v, ok := t.hosts.Load(stats.host); ok && v == stats {
+            t.hosts.Delete(stats.host)
+        }
+    }
+}
+
+func (t *poolTransport) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+    conn, err := dialer.DialContext(ctx, network, addr)
+
+    stats := t.host(addr)
+    atomic.AddInt64(&stats.dials, 1)
+    if err != nil {
+        atomic.AddInt64(&stats.dialErrors, 1)
+        return nil, err
+    }
+
+    atomic.AddInt64(&stats.open, 1)
+    c := &trackedConn{Conn: conn}
+    c.done = func() {
+        t.Lock()
+        delete(stats.conns, c)
+        t.Unlock()
+
+        t.done(stats, atomic.AddInt64(&stats.open, -1))
+    }
+
+    t.Lock()
+    stats.conns[c] = true
+    t.Unlock()
+
+    return c, nil
+}
+
+func (t *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    stats := t.host(req.URL.Host)
+    atomic.AddInt64(&stats.active, 1)
+
+    res, err := t.Transport.RoundTrip(req)
+    if err != nil {
+        t.release(stats)
+        return nil, err
+    }
+
+    res.Body = &trackedBody{ReadCloser: res.Body, done: func() { t.release(stats) }}
+    return res, nil
+}
+
+func (t *poolTransport) release(stats *hostStats) {
+    t.done(stats, atomic.AddInt64(&stats.active, -1))
+
+    // connections of a retired transport go back to its idle list once the
+    // in-flight request finishes, close them right away
+    if atomic.LoadInt32(&t.retired) == 1 {
+        t.CloseIdleConnections()
+    }
+}
+
+// forget closes the connections to a node removed from the pool, those of
+// in-flight requests once the requests finish. Connections to other nodes
+// are kept.
+func (t *poolTransport) forget(addr string) {
+    var conns []*trackedConn
+
+    t.Lock()
+    if v, ok := t.hosts.Load(addr); ok {
+        stats := v.(*hostStats)
+        atomic.StoreInt32(&stats.gone, 1)
+        conns = t.drain(stats)
+        t.sweep(stats)
+    }
+    t.Unlock()
+
+    closeConns(conns)
+}
+
+// retire tears the transport down after its pool is deleted or reconfigured.
+func (t *poolTransport) retire() {
+    atomic.StoreInt32(&t.retired, 1)
+    t.CloseIdleConnections()
+}
+
+func (t *poolTransport) Stats() []*ConnStats {
+    result := make([]*ConnStats, 0)
+    t.hosts.Range(func(_, v interface{}) bool {
+        stats := v.(*hostStats)
+        s := &ConnStats{
+            Host:       stats.host,
+            Open:       int(atomic.LoadInt64(&stats.open)),
+            Active:     int(atomic.LoadInt64(&stats.active)),
+            Dials:      int(atomic.LoadInt64(&stats.dials)),
+            DialErrors: int(atomic.LoadInt64(&stats.dialErrors)),
+        }
+        if s.Idle = s.Open - s.Active; s.Idle < 0 {
+            s.Idle = 0
+        }
+        result = append(result, s)
+        return true
+    })
+
+    sort.Sort(connStatsByHost(result))
+    return result
+}
+
+type connStatsByHost []*ConnStats
+
+func (cs connStatsByHost) Len() int           { return len(cs) }
+func (cs connStatsByHost) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs connStatsByHost) Less(i, j int) bool { return cs[i].Host < cs[j].Host }
+
+////////////////////////////////////////////////////////////////////////////////
+
+type trackedConn struct {
+    net.Conn
+    once sync.Once
+    done func()
+}
+
+func (c *trackedConn) Close() error {
+    c.once.Do(c.done)
+    return c.Conn.Close()
+}
+
+type trackedBody struct {
+    io.ReadCloser
+    once sync.Once
+    done func()
+}
+
+func (b *trackedBody) Close() error {
+    err := b.ReadCloser.Close()
+    b.once.Do(b.done)
+    return err
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+)
+
+func transportGet(t *testing.T, tr *poolTransport, url string) *http.Response {
+    req, _ := http.NewRequest("GET", url, nil)
+    res, err := tr.RoundTrip(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return res
+}
+
+func oneStats(t *testing.T, tr *poolTransport) ConnStats {
+    stats := tr.Stats()
+    if len(stats) != 1 {
+        t.Fatalf("stats of %d hosts, want 1", len(stats))
+    }
+
+    return *stats[0]
+}
+
+func TestTransportStats(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer ts.Close()
+
+    tr := newPoolTransport(nil)
+    defer tr.retire()
+
+    res := transportGet(t, tr, ts.URL)
+    if s := oneStats(t, tr); s.Host != backendHost(ts) || s.Open != 1 || s.Active != 1 || s.Idle != 0 || s.Dials != 1 {
+        t.Errorf("stats in flight = %+v", s)
+    }
+
+    ioutil.ReadAll(res.Body)
+    res.Body.Close()
+    if s := oneStats(t, tr); s.Open != 1 || s.Active != 0 || s.Idle != 1 {
+        t.Errorf("stats after the response = %+v", s)
+    }
+
+    // the idle connection is reused
+    res = transportGet(t, tr, ts.URL)
+    ioutil.ReadAll(res.Body)
+    res.Body.Close()
+    if s := oneStats(t, tr); s.Dials != 1 {
+        t.Errorf("dials = %d, want 1", s.Dials)
+    }
+}
+
+func TestTransportDialError(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := l.Addr().String()
+    l.Close()
+
+    tr := newPoolTransport(nil)
+    req, _ := http.NewRequest("GET", "http://"+addr, nil)
+    if _, err := tr.RoundTrip(req); err == nil {
+        t.Fatal("request to a closed port succeeded")
+    }
+
+    if s := oneStats(t, tr); s.Dials != 1 || s.DialErrors != 1 || s.Open != 0 || s.Active != 0 {
+        t.Errorf("stats = %+v", s)
+    }
+}
+
+func TestTransportForget(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer ts.Close()
+
+    tr := newPoolTransport(nil)
+    defer tr.retire()
+
+    res := transportGet(t, tr, ts.URL)
+
+    // the host is removed while a request is in flight, its stats stay
+    // until the connection is gone
+    tr.forget(backendHost(ts))
+    if s := oneStats(t, tr); s.Active != 1 {
+        t.Errorf("stats in flight = %+v", s)
+    }
+
+    ioutil.ReadAll(res.Body)
+    res.Body.Close()
+    tr.forget(backendHost(ts))
+    if stats := tr.Stats(); len(stats) != 0 {
+        t.Errorf("stats of a forgotten host = %+v", stats[0])
+    }
+}
+
+func TestTransportForgetKeepsOtherHosts(t *testing.T) {
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+    a, b := httptest.NewServer(handler), httptest.NewServer(handler)
+    defer a.Close()
+    defer b.Close()
+
+    tr := newPoolTransport(nil)
+    defer tr.retire()
+
+    for _, ts := range []*httptest.Server{a, b} {
+        res := transportGet(t, tr, ts.URL)
+        ioutil.ReadAll(res.Body)
+        res.Body.Close()
+    }
+
+    tr.forget(backendHost(a))
+    if s := oneStats(t, tr); s.Host != backendHost(b) || s.Idle != 1 {
+        t.Errorf("stats after forgetting %s = %+v, want the idle connection to %s", backendHost(a), s, backendHost(b))
+    }
+
+    res := transportGet(t, tr, b.URL)
+    ioutil.ReadAll(res.Body)
+    res.Body.Close()
+    if s := oneStats(t, tr); s.Dials != 1 {
+        t.Errorf("dials of %s = %d, want the connection reused", backendHost(b), s.Dials)
+    }
+}
+
+func TestTransportRetire(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer ts.Close()
+
+    tr := newPoolTransport(nil)
+    res := transportGet(t, tr, ts.URL)
+
+    tr.retire()
+    ioutil.ReadAll(res.Body)
+    res.Body.Close()
+    if s := oneStats(t, tr); s.Open != 0 || s.Active != 0 {
+        t.Errorf("stats of a retired transport = %+v, want no connection", s)
+    }
+}
+
+func TestDeleteServiceRetiresTransports(t *testing.T) {
+    p := newTestProxy(t)
+    m := &Mirror{Host: "127.0.0.1:1", Percent: 10}
+    validated(t, m)
+
+    if err := p.PutServiceMirror("s", m); err != nil {
+        t.Fatal(err)
+    }
+
+    s := p.Services[0]
+    if err := p.DeleteService("s", 0); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, pool := range s.Pools {
+        if atomic.LoadInt32(&pool.transport.retired) == 0 {
+            t.Errorf("transport of pool %s not retired", pool.Name)
+        }
+    }
+
+    if atomic.LoadInt32(&s.Mirror.client.retired) == 0 {
+        t.Error("mirror client not retired")
+    }
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync/atomic"
+)
+
+// versions numbers the changes of services, pools and nodes. It is shared by
+// all of them, so that a version is never given twice, not even to a
+// resource deleted and created again under the same name.
+var versions uint64
+
+func nextVersion() uint64 {
+    return atomic.AddUint64(&versions, 1)
+}
+
+// conflictError is returned by the admin calls given a version other than
+// the current one of the resource, the admin API answers it with 412.
+type conflictError struct {
+    resource string
+    version  uint64
+}
+
+func (e *conflictError) Error() string {
+    return fmt.Sprintf("%s is at version %d", e.resource, e.version)
+}
+
+// checkVersion tells whether a change made against one of versions may apply
+// to the resource now at current, no versions or a version 0 match any.
+func checkVersion(resource string, current uint64, versions []uint64) error {
+    if len(versions) == 0 {
+        return nil
+    }
+
+    for _, version := range versions {
+        if version == 0 || version == current {
+            return nil
+        }
+    }
+
+    return &conflictError{resource: resource, version: current}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func etag(version uint64) string {
+    return fmt.Sprintf(`"%d"`, version)
+}
+
+// ifMatch returns the versions of the If-Match header, none if the header is
+// missing or `*`. Versions are given as the ETag of the GET, e.g. `"12"`, or
+// a list of them, e.g. `"12", "13"`, the change applies if any matches.
+// If-Match compares strongly, so weak tags like `W/"12"` are rejected.
+func ifMatch(r *http.Request) ([]uint64, error) {
+    h := strings.TrimSpace(strings.Join(r.Header.Values("If-Match"), ","))
+    if len(h) == 0 || h == "*" {
+        return nil, nil
+    }
+
+    versions := make([]uint64, 0)
+    for _, tag := range strings.Split(h, ",") {
+        tag = strings.TrimSpace(tag)
+        if strings.HasPrefix(tag, "W/") {
+            return nil, fmt.Errorf("weak tag %s in If-Match", tag)
+        }
+
+        version, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64)
+        if err != nil || version == 0 {
+            return nil, fmt.Errorf("invalid If-Match %s", h)
+        }
+        versions = append(versions, version)
+    }
+
+    return versions, nil
+}
+
+// adminError answers err of a conditional admin call, 412 on a version
+// conflict and 400 otherwise.
+func adminError(w http.ResponseWriter, err error) {
+    var conflict *conflictError
+    if errors.As(err, &conflict) {
+        http.Error(w, err.Error(), http.StatusPreconditionFailed)
+        return
+    }
+
+    http.Error(w, err.Error(), http.StatusBadRequest)
+}
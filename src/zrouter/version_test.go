@@ -0,0 +1,185 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func isConflict(err error) bool {
+    var conflict *conflictError
+    return errors.As(err, &conflict)
+}
+
+func TestVersionNode(t *testing.T) {
+    p := newTestProxy(t, &Node{Name: "n1", Host: "127.0.0.1:1", Status: "on"})
+
+    node, _ := p.GetServicePoolNode("s", "prod", "n1")
+    v := node.Version
+    if v == 0 {
+        t.Fatal("node created without a version")
+    }
+
+    if err := p.PutServicePoolNode("s", "prod", &Node{Name: "n1", Status: "off"}, v); err != nil {
+        t.Fatal(err)
+    }
+
+    // a second pipeline still holding the old version
+    if err := p.PutServicePoolNode("s", "prod", &Node{Name: "n1", Status: "on"}, v); !isConflict(err) {
+        t.Errorf("put of version %d = %v, want conflict", v, err)
+    }
+
+    if err := p.DeleteServicePoolNode("s", "prod", "n1", v); !isConflict(err) {
+        t.Errorf("delete of version %d = %v, want conflict", v, err)
+    }
+
+    node, _ = p.GetServicePoolNode("s", "prod", "n1")
+    if node.Status != "off" || node.Version <= v {
+        t.Errorf("node = %+v, want off above version %d", node, v)
+    }
+
+    if err := p.DeleteServicePoolNode("s", "prod", "n1", node.Version); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestVersionUnloading(t *testing.T) {
+    p := newTestProxy(t, &Node{Name: "n1", Host: "127.0.0.1:1", Status: "on"})
+
+    s := p.Services[0]
+    pool, node := s.defaultPool(), s.defaultPool().Nodes[0]
+    if !node.take() {
+        t.Fatal("take failed")
+    }
+
+    p.PutServicePoolNode("s", "prod", &Node{Name: "n1", Status: "unloading"}, 0)
+    v := node.Version
+
+    // the last request turns the node off, a change the admin did not make
+    p.decreaseConn(pool, node)
+    if view, _ := p.GetServicePoolNode("s", "prod", "n1"); view.Status != "off" || view.Version <= v {
+        t.Errorf("node = %+v, want off above version %d", view, v)
+    }
+}
+
+func TestVersionServiceAndPool(t *testing.T) {
+    p := newTestProxy(t)
+
+    s, _ := p.GetService("s")
+    if err := p.PutService(&Service{Name: "s", Url: "/a/"}, s.Version); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := p.PutService(&Service{Name: "s", Url: "/b/"}, s.Version); !isConflict(err) {
+        t.Errorf("put of version %d = %v, want conflict", s.Version, err)
+    }
+
+    if err := p.DeleteService("s", s.Version); !isConflict(err) {
+        t.Errorf("delete of version %d = %v, want conflict", s.Version, err)
+    }
+
+    pool, _ := p.GetServicePool("s", "gray")
+    if err := p.PutServicePool("s", "gray", &Pool{LBPolicy: "random"}, pool.Version); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := p.DeleteServicePool("s", "gray", pool.Version); !isConflict(err) {
+        t.Errorf("delete of version %d = %v, want conflict", pool.Version, err)
+    }
+
+    err := p.Batch(batchOps(t, `[{"op": "set_pool_pattern", "service": "s", "pool": "gray", "version": 1, "body": null}]`))
+    if !isConflict(err) {
+        t.Errorf("batch of version 1 = %v, want conflict", err)
+    }
+}
+
+func TestVersionAPI(t *testing.T) {
+    router := NewRouter()
+    do := func(method, path, match, body string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(method, path, strings.NewReader(body))
+        if len(match) > 0 {
+            req.Header.Set("If-Match", match)
+        }
+
+        rw := httptest.NewRecorder()
+        router.ServeHTTP(rw, req)
+        return rw
+    }
+
+    if rw := do("POST", "/api/services", "", `{"name": "version-api"}`); rw.Code != http.StatusOK {
+        t.Fatalf("POST service: %d %s", rw.Code, rw.Body)
+    }
+    defer proxy.DeleteService("version-api", 0)
+
+    path := "/api/services/version-api/pools/prod/nodes"
+    do("POST", path, "", `{"name": "n1", "host": "127.0.0.1:1", "status": "on"}`)
+
+    etag := do("GET", path+"/n1", "", "").Header().Get("ETag")
+    if len(etag) == 0 {
+        t.Fatal("no ETag of node")
+    }
+
+    for _, c := range []struct {
+        match string
+        code  int
+    }{
+        {etag, http.StatusOK},
+        {etag, http.StatusPreconditionFailed},
+        {"*", http.StatusOK},
+        {"", http.StatusOK},
+        {`"x"`, http.StatusBadRequest},
+    } {
+        if rw := do("PUT", path+"/n1", c.match, `{"status": "off"}`); rw.Code != c.code {
+            t.Errorf("PUT If-Match %s: %d %s, want %d", c.match, rw.Code, rw.Body, c.code)
+        }
+    }
+
+    etag = do("GET", path+"/n1", "", "").Header().Get("ETag")
+    for _, c := range []struct {
+        match string
+        code  int
+    }{
+        {"W/" + etag, http.StatusBadRequest},
+        {`"1", "2"`, http.StatusPreconditionFailed},
+        {`"1", ` + etag, http.StatusOK},
+    } {
+        if rw := do("PUT", path+"/n1", c.match, `{"status": "off"}`); rw.Code != c.code {
+            t.Errorf("PUT If-Match %s: %d %s, want %d", c.match, rw.Code, rw.Body, c.code)
+        }
+    }
+}
+
+func TestIfMatch(t *testing.T) {
+    for _, c := range []struct {
+        match    string
+        versions string
+        invalid  bool
+    }{
+        {"", "[]", false},
+        {"*", "[]", false},
+        {`"12"`, "[12]", false},
+        {`"12", "13"`, "[12 13]", false},
+        {`"12","13"`, "[12 13]", false},
+        {`W/"12"`, "", true},
+        {`"12", W/"13"`, "", true},
+        {`"0"`, "", true},
+        {`"x"`, "", true},
+    } {
+        req := httptest.NewRequest("PUT", "/", nil)
+        req.Header.Set("If-Match", c.match)
+        versions, err := ifMatch(req)
+        if c.invalid {
+            if err == nil {
+                t.Errorf("If-Match %s accepted as %v", c.match, versions)
+            }
+            continue
+        }
+
+        if err != nil || fmt.Sprint(versions) != c.versions {
+            t.Errorf("If-Match %s = %v, %v, want %s", c.match, versions, err, c.versions)
+        }
+    }
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "sync/atomic"
+)
+
+// The admin API returns copies of the live state, the JSON encoder reads
+// them after the proxy lock is released while ServeHTTP and the rollouts go
+// on changing the originals. Configs are replaced rather than modified, so
+// the copies share them.
+
+func (s *Service) view() *Service {
+    v := *s
+    v.Pools = nil
+    v.Rollouts = nil
+    return &v
+}
+
+func (p *Pool) view() *Pool {
+    v := *p
+    v.Nodes = viewNodes(p.Nodes)
+    v.Stats = p.transport.Stats()
+    v.Pending = int(atomic.LoadInt64(&p.queue.pending))
+    return &v
+}
+
+func (n *Node) view() *Node {
+    v := *n
+    v.ConnNum = n.connNum()
+    return &v
+}
+
+func viewNodes(nodes []*Node) []*Node {
+    views := make([]*Node, len(nodes))
+    for i, node := range nodes {
+        views[i] = node.view()
+    }
+
+    return views
+}
+
+func (st *RolloutStatus) view() *RolloutStatus {
+    v := *st
+    v.History = make([]*RolloutStep, len(st.History))
+    for i, step := range st.History {
+        s := *step
+        v.History[i] = &s
+    }
+
+    return &v
+}
+
+func (pr *Promotion) view() *Promotion {
+    v := *pr
+    v.Previous = viewNodes(pr.Previous)
+    v.Promoted = viewNodes(pr.Promoted)
+    return &v
+}